@@ -0,0 +1,130 @@
+package indicators
+
+import (
+	"fmt"
+)
+
+// Counts of a Scanner's FSM activity since it was created or last Reset,
+// showing how much work scanning has taken.
+type ScanStats struct {
+
+	// FSMs and products activated.
+	Activated uint64
+
+	// FSMs dropped from the active set on reaching 'fail'.
+	Failed uint64
+
+	// FSMs dropped from the active set on reaching 'hit', see
+	// Scanner.DropHits.
+	Retired uint64
+
+	// Steps of an active FSM or product, one for each symbol applied to
+	// each.
+	Steps uint64
+
+	// The largest number of FSMs and products active at once.
+	MaxActive int
+}
+
+// Adds another set of statistics to this one, e.g. to total them over
+// several scans.  MaxActive becomes the larger of the two.
+func (s *ScanStats) Add(o ScanStats) {
+	s.Activated += o.Activated
+	s.Failed += o.Failed
+	s.Retired += o.Retired
+	s.Steps += o.Steps
+	if o.MaxActive > s.MaxActive {
+		s.MaxActive = o.MaxActive
+	}
+}
+
+func (s ScanStats) String() string {
+	return fmt.Sprintf("activated %d, failed %d, retired %d, steps %d, "+
+		"max active %d", s.Activated, s.Failed, s.Retired, s.Steps,
+		s.MaxActive)
+}
+
+// Returns the number of FSMs and products in the active set.
+func (s *Scanner) Active() int {
+	return len(s.State) + len(s.ProductState)
+}
+
+// Returns the current state of an FSM, whether active, running in a
+// product, or dropped from the active set.  Returns false if the FSM has
+// not been activated.
+func (s *Scanner) StateOf(fsm int32) (int32, bool) {
+	if state, ok := s.State[fsm]; ok {
+		return state, true
+	}
+	if state, ok := s.Done[fsm]; ok {
+		return state, true
+	}
+	r := s.Ruleset
+	if r.Grouped != nil && r.Grouped[fsm] >= 0 {
+		id := r.Grouped[fsm]
+		if state, ok := s.ProductState[id]; ok {
+			p := r.Products[id]
+			for i, member := range p.Members {
+				if member == fsm {
+					c := p.Component(state, i)
+					return c, c != StateInit
+				}
+			}
+		}
+	}
+	return StateInit, false
+}
+
+// Drops an FSM from the active set if it has reached a state it can never
+// leave: 'fail', or 'hit' if DropHits is set.  Dropped FSMs are kept in
+// Done so that they are not activated again.
+func (s *Scanner) drop(fsm, state int32) {
+
+	switch state {
+	case StateFail:
+		s.ScanStats.Failed++
+		delete(s.paths, fsm)
+	case StateHit:
+		if !s.DropHits || !s.Ruleset.Fsms[fsm].Final(state) {
+			return
+		}
+		s.ScanStats.Retired++
+	default:
+		return
+	}
+
+	delete(s.State, fsm)
+	delete(s.Started, fsm)
+	delete(s.events, fsm)
+	s.Done[fsm] = state
+
+}
+
+// Drops a product from the active set if it has reached a state it can
+// never leave, moving its members' states to Done.
+func (s *Scanner) dropProduct(id, state int32) {
+
+	p := s.Ruleset.Products[id]
+	if !s.DropHits && len(p.Hits[state]) > 0 {
+		return
+	}
+	if !p.Table.Final(state) {
+		return
+	}
+
+	for i, fsm := range p.Members {
+		switch c := p.Component(state, i); c {
+		case StateFail:
+			s.ScanStats.Failed++
+			delete(s.paths, fsm)
+			s.Done[fsm] = c
+		case StateHit:
+			s.ScanStats.Retired++
+			s.Done[fsm] = c
+		}
+	}
+
+	delete(s.ProductState, id)
+	s.doneProducts[id] = true
+
+}
@@ -0,0 +1,114 @@
+package indicators
+
+import (
+	"testing"
+)
+
+const activeIndicators = `{"indicators": [
+	{"id": "hit", "type": "t", "value": "a"},
+	{"id": "fail", "and": [
+		{"type": "t", "value": "b"},
+		{"not": {"type": "t", "value": "c"}}
+	]},
+	{"id": "other", "and": [
+		{"type": "t", "value": "a"},
+		{"type": "t", "value": "d"}
+	]}
+]}`
+
+// FSMs which can't leave their state are dropped from the active set, but
+// their states can still be found, and they aren't activated again.
+func TestDropFinished(t *testing.T) {
+
+	ii, err := LoadIndicators([]byte(activeIndicators))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta := Token{Type: "t", Value: "a"}
+	tc := Token{Type: "t", Value: "c"}
+
+	for _, product := range []bool{false, true} {
+		for _, dropHits := range []bool{false, true} {
+
+			opts := CompileOptions{Product: product}
+			rs, err := CreateRuleset(ii, &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := rs.NewScanner()
+			s.DropHits = dropHits
+
+			s.Update(ta)
+			s.Update(tc)
+			s.Update(ta)
+
+			for fsm, expect := range []int32{StateHit, StateFail} {
+				state, ok := s.StateOf(int32(fsm))
+				if !ok || state != expect {
+					t.Errorf("product=%v drop=%v: FSM %d "+
+						"in state %d, %v", product,
+						dropHits, fsm, state, ok)
+				}
+			}
+			state, ok := s.StateOf(2)
+			if !ok || state == StateHit || state == StateFail {
+				t.Errorf("product=%v drop=%v: FSM 2 in "+
+					"state %d, %v", product, dropHits,
+					state, ok)
+			}
+
+			hits := s.GetHits()
+			if len(hits) != 1 || hits[0].Id != "hit" {
+				t.Errorf("product=%v drop=%v: wrong hits %v",
+					product, dropHits, hits)
+			}
+
+			if product {
+				continue
+			}
+
+			// 'hit' and 'other' are activated by a, and 'fail'
+			// by c.  The second a activates nothing.
+			st := s.ScanStats
+			if st.Activated != 3 || st.Failed != 1 {
+				t.Errorf("drop=%v: wrong stats %v", dropHits,
+					st)
+			}
+
+			// With DropHits, 'hit' is dropped as soon as a
+			// activates it, and 'fail' as soon as c does.
+			retired, active := uint64(0), 2
+			if dropHits {
+				retired, active = 1, 1
+			}
+			if st.Retired != retired || s.Active() != active {
+				t.Errorf("drop=%v: %d retired, %d active",
+					dropHits, st.Retired, s.Active())
+			}
+			if st.MaxActive != active {
+				t.Errorf("drop=%v: max active %d", dropHits,
+					st.MaxActive)
+			}
+
+			s.Reset()
+			if s.Active() != 0 || s.ScanStats != (ScanStats{}) {
+				t.Errorf("drop=%v: reset left %d active, %v",
+					dropHits, s.Active(), s.ScanStats)
+			}
+
+		}
+	}
+
+}
+
+func TestScanStatsAdd(t *testing.T) {
+	a := ScanStats{Activated: 1, Failed: 2, Retired: 3, Steps: 4,
+		MaxActive: 5}
+	a.Add(ScanStats{Activated: 1, Failed: 1, Retired: 1, Steps: 1,
+		MaxActive: 7})
+	expect := ScanStats{Activated: 2, Failed: 3, Retired: 4, Steps: 5,
+		MaxActive: 7}
+	if a != expect {
+		t.Errorf("expected %v, got %v", expect, a)
+	}
+}
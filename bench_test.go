@@ -0,0 +1,150 @@
+package indicators
+
+import (
+	"flag"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Scanning benchmarks, on a large synthetic indicator set.  Each op is one
+// token; the Scanner is reset, as for a new flow, every benchFlow tokens.
+//
+//	go test -run XXX -bench Scan -benchindicators 100000
+
+var benchIndicators = flag.Int("benchindicators", 100000,
+	"number of indicators for scanning benchmarks")
+
+const benchFlow = 1000
+
+// Returns a random token from a vocabulary of the given size.
+func benchToken(rng *rand.Rand, vocab int) Token {
+	types := []string{"ipv4", "hostname", "url", "tcp", "email"}
+	n := rng.Intn(vocab)
+	return Token{Type: types[n%len(types)],
+		Value: "value-" + strconv.Itoa(n)}
+}
+
+// Generates a synthetic indicator set: mostly single match terms, with
+// some ANDs, and some ANDs with a NOT clause.  Half the token stream is
+// from the indicators' vocabulary, half never matches.
+func benchData(count int) (*Indicators, []Token) {
+
+	vocab := count / 2
+	rng := rand.New(rand.NewSource(1))
+	term := func() *Term {
+		t := benchToken(rng, vocab)
+		return &Term{Type: t.Type, Value: t.Value}
+	}
+
+	ii := &Indicators{}
+	for i := 0; i < count; i++ {
+		ind := &Indicator{Id: "ind-" + strconv.Itoa(i)}
+		switch r := rng.Intn(10); {
+		case r < 6:
+			ind.Term = *term()
+		case r < 9:
+			ind.And = []*Term{term(), term()}
+		default:
+			ind.And = []*Term{term(), {Not: term()}}
+		}
+		ii.Add(ind)
+	}
+
+	stream := make([]Token, 10*benchFlow)
+	for i := range stream {
+		stream[i] = benchToken(rng, vocab*2)
+	}
+
+	return ii, stream
+
+}
+
+// Compiled forms of the benchmark indicators, built once.
+var bench struct {
+	sync.Once
+	stream  []Token
+	fsms    *Ruleset
+	product *Ruleset
+	maps    map[Token][]*FsmMap
+}
+
+func benchSetup(b *testing.B) {
+	bench.Do(func() {
+		ii, stream := benchData(*benchIndicators)
+		bench.stream = stream
+		var err error
+		bench.fsms, err = CreateRuleset(ii, &DefaultCompileOptions)
+		if err != nil {
+			b.Fatal(err)
+		}
+		opts := DefaultCompileOptions
+		opts.Product = true
+		bench.product, err = CreateRuleset(ii, &opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		bench.maps = map[Token][]*FsmMap{}
+		for _, ind := range ii.Indicators {
+			fsm := ind.GenerateFsmLazy()
+			m := fsm.Mapify()
+			for _, token := range fsm.GetActivators() {
+				bench.maps[token] = append(bench.maps[token], m)
+			}
+		}
+	})
+	b.ResetTimer()
+}
+
+// Scans with string-keyed FsmMaps, one map lookup per active FSM per
+// token, as before state tables.
+func BenchmarkScanFsmMap(b *testing.B) {
+	benchSetup(b)
+	var state map[*FsmMap]string
+	for i := 0; i < b.N; i++ {
+		if i%benchFlow == 0 {
+			state = map[*FsmMap]string{}
+		}
+		token := bench.stream[i%len(bench.stream)]
+		for _, fsm := range bench.maps[token] {
+			if _, ok := state[fsm]; !ok {
+				state[fsm] = "init"
+			}
+		}
+		for fsm, s := range state {
+			event := FsmEvent{State: s, Token: token}
+			if next, ok := (*fsm)[event]; ok {
+				state[fsm] = next
+			}
+		}
+	}
+}
+
+func benchScan(b *testing.B, product, dropHits bool) {
+	benchSetup(b)
+	rs := bench.fsms
+	if product {
+		rs = bench.product
+	}
+	s := rs.NewScanner()
+	s.DropHits = dropHits
+	for i := 0; i < b.N; i++ {
+		if i%benchFlow == 0 {
+			s.Reset()
+		}
+		s.Update(bench.stream[i%len(bench.stream)])
+	}
+}
+
+func BenchmarkScanStateTable(b *testing.B) {
+	benchScan(b, false, false)
+}
+
+func BenchmarkScanDropHits(b *testing.B) {
+	benchScan(b, false, true)
+}
+
+func BenchmarkScanProduct(b *testing.B) {
+	benchScan(b, true, false)
+}
@@ -0,0 +1,172 @@
+package indicators
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+)
+
+// Match term flavours for ipv4 and ipv6 tokens.
+const (
+	// Token address must be inside the CIDR block in the term value
+	// e.g. 10.0.0.0/8.
+	MatchCIDR = "cidr"
+
+	// Token address must be inside the inclusive address range in the
+	// term value e.g. 10.0.0.1-10.0.0.200.
+	MatchRange = "range"
+)
+
+// Returns the address length in bytes for an address token type, or 0 if
+// the type isn't an address type.
+func addressLength(typ string) int {
+	switch typ {
+	case "ipv4":
+		return net.IPv4len
+	case "ipv6":
+		return net.IPv6len
+	}
+	return 0
+}
+
+// Parses an address of the given token type.  Returns nil if the address
+// isn't valid, or is the wrong family for the type.  IPv4-mapped addresses
+// e.g. ::ffff:10.0.0.1 are IPv6 addresses.
+func parseAddress(typ, value string) net.IP {
+	ip := net.ParseIP(strings.TrimSpace(value))
+	if ip == nil {
+		return nil
+	}
+	ipv6 := strings.Contains(value, ":")
+	switch {
+	case typ == "ipv4" && !ipv6:
+		return ip.To4()
+	case typ == "ipv6" && ipv6:
+		return ip.To16()
+	}
+	return nil
+}
+
+// Parses the value of a CIDR or range term to the list of CIDR blocks it
+// covers.  A range is broken down into the smallest set of blocks.
+func parsePrefixes(typ, match, value string) ([]*net.IPNet, error) {
+
+	length := addressLength(typ)
+	if length == 0 {
+		return nil, fmt.Errorf("%s match not supported for type %q",
+			match, typ)
+	}
+
+	// IPv4-mapped IPv6 blocks e.g. ::ffff:10.0.0.0/104 are IPv6 blocks,
+	// as IPv4-mapped addresses are IPv6 addresses, see NormaliseIPv6.
+	if match == MatchCIDR {
+		_, block, err := net.ParseCIDR(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		addr := strings.SplitN(strings.TrimSpace(value), "/", 2)[0]
+		if parseAddress(typ, addr) == nil ||
+			len(block.Mask) != length {
+			return nil, fmt.Errorf("%q is not an %s block", value,
+				typ)
+		}
+		if length == net.IPv4len {
+			block.IP = block.IP.To4()
+		} else {
+			block.IP = block.IP.To16()
+		}
+		return []*net.IPNet{block}, nil
+	}
+
+	ends := strings.Split(value, "-")
+	if len(ends) != 2 {
+		return nil, fmt.Errorf("%q is not an address range", value)
+	}
+	first := parseAddress(typ, ends[0])
+	last := parseAddress(typ, ends[1])
+	if first == nil || last == nil {
+		return nil, fmt.Errorf("%q is not an %s range", value, typ)
+	}
+
+	start := new(big.Int).SetBytes(first)
+	end := new(big.Int).SetBytes(last)
+	if start.Cmp(end) > 0 {
+		return nil, fmt.Errorf("range %q is backwards", value)
+	}
+
+	// Repeatedly take the largest block which starts at 'start' and
+	// doesn't go past 'end'.
+	bits := length * 8
+	one := big.NewInt(1)
+	blocks := []*net.IPNet{}
+	for start.Cmp(end) <= 0 {
+		size := 0
+		for size < bits && start.Bit(size) == 0 {
+			next := new(big.Int).Lsh(one, uint(size+1))
+			next.Add(next, start)
+			next.Sub(next, one)
+			if next.Cmp(end) > 0 {
+				break
+			}
+			size++
+		}
+		ip := make(net.IP, length)
+		b := start.Bytes()
+		copy(ip[length-len(b):], b)
+		blocks = append(blocks, &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(bits-size, bits),
+		})
+		start.Add(start, new(big.Int).Lsh(one, uint(size)))
+	}
+
+	return blocks, nil
+
+}
+
+// A binary trie of address prefixes.  Each node is a prefix, and holds
+// the symbols of terms for that prefix.  Looking up an address walks one
+// path from the root, so the cost depends on the address length, not on
+// the number of prefixes.
+type prefixTrie struct {
+	child   [2]*prefixTrie
+	symbols []int32
+}
+
+// Returns bit i of an address, counting from the most significant bit.
+func addressBit(addr []byte, i int) int {
+	return int(addr[i/8]>>(7-uint(i%8))) & 1
+}
+
+// Adds a prefix to the trie.
+func (t *prefixTrie) insert(block *net.IPNet, sym int32) {
+	ones, _ := block.Mask.Size()
+	node := t
+	for i := 0; i < ones; i++ {
+		b := addressBit(block.IP, i)
+		if node.child[b] == nil {
+			node.child[b] = &prefixTrie{}
+		}
+		node = node.child[b]
+	}
+	for _, v := range node.symbols {
+		if v == sym {
+			return
+		}
+	}
+	node.symbols = append(node.symbols, sym)
+}
+
+// Appends the symbols for all prefixes containing addr to syms.
+func (t *prefixTrie) lookup(addr net.IP, syms []int32) []int32 {
+	node := t
+	for i := 0; node != nil; i++ {
+		syms = append(syms, node.symbols...)
+		if i == len(addr)*8 {
+			break
+		}
+		node = node.child[addressBit(addr, i)]
+	}
+	return syms
+}
@@ -0,0 +1,45 @@
+package indicators
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+// Returns a block as address/length, with IPv4-mapped addresses dotted.
+func prefix(block *net.IPNet) string {
+	ones, _ := block.Mask.Size()
+	return block.IP.String() + "/" + strconv.Itoa(ones)
+}
+
+// IPv4-mapped blocks are IPv6 blocks, consistently with NormaliseIPv6.
+func TestParsePrefixes(t *testing.T) {
+	for _, c := range []struct {
+		typ, match, value string
+		expect            string
+	}{
+		{"ipv4", MatchCIDR, "10.0.0.0/8", "10.0.0.0/8"},
+		{"ipv6", MatchCIDR, "2001:db8::/32", "2001:db8::/32"},
+		{"ipv6", MatchCIDR, "::ffff:10.0.0.0/104", "10.0.0.0/104"},
+		{"ipv4", MatchCIDR, "::ffff:10.0.0.0/104", ""},
+		{"ipv6", MatchCIDR, "10.0.0.0/8", ""},
+		{"ipv6", MatchRange, "::ffff:10.0.0.0-::ffff:10.0.0.255",
+			"10.0.0.0/120"},
+		{"ipv4", MatchRange, "10.0.0.0-::ffff:10.0.0.255", ""},
+	} {
+		blocks, err := parsePrefixes(c.typ, c.match, c.value)
+		if c.expect == "" {
+			if err == nil {
+				t.Errorf("%s %s: expected an error, got %v",
+					c.typ, c.value, blocks)
+			}
+			continue
+		}
+		if err != nil || len(blocks) != 1 ||
+			len(blocks[0].IP) != addressLength(c.typ) ||
+			prefix(blocks[0]) != c.expect {
+			t.Errorf("%s %s: expected %s, got %v %v", c.typ,
+				c.value, c.expect, blocks, err)
+		}
+	}
+}
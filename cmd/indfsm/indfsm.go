@@ -0,0 +1,115 @@
+// Tools for looking at the FSMs compiled from an indicator file.
+//
+//	go run ./cmd/indfsm diagram [-format dot|mermaid] [-terms] \
+//		[-out dir] indicators.json
+//
+// The diagram subcommand writes one diagram per indicator, named after the
+// indicator ID, in dot or mermaid format, to the -out directory.  -terms
+// annotates each state with the terms true in it.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	det "github.com/cybermaggedon/indicators"
+)
+
+// Characters which aren't safe in file names.
+var unsafe = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+func diagram(args []string) {
+
+	fs := flag.NewFlagSet("diagram", flag.ExitOnError)
+	format := fs.String("format", "dot", "dot or mermaid")
+	terms := fs.Bool("terms", false, "annotate states with their terms")
+	out := fs.String("out", ".", "output directory")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: indfsm diagram [-format dot|mermaid] "+
+			"[-terms] [-out dir] file")
+		os.Exit(2)
+	}
+
+	ext := map[string]string{"dot": ".dot", "mermaid": ".mmd"}[*format]
+	if ext == "" {
+		log.Fatalf("Unknown format %q", *format)
+	}
+
+	ii, err := det.LoadIndicatorsFromFile(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	err = os.MkdirAll(*out, 0755)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	used := map[string]int{}
+
+	for _, ind := range ii.Indicators {
+
+		fsm, err := ind.CompileFsm(&det.DefaultCompileOptions)
+		if err != nil {
+			log.Printf("Skipping %s: %v", ind.Id, err)
+			continue
+		}
+
+		opts := &det.DiagramOptions{Title: ind.Id}
+		if *terms {
+			opts.Navigator = ind.BuildNavigator()
+		}
+
+		// IDs aren't necessarily unique.
+		name := unsafe.ReplaceAllString(ind.Id, "_")
+		used[name]++
+		if used[name] > 1 {
+			name += "-" + strconv.Itoa(used[name])
+		}
+		path := filepath.Join(*out, name+ext)
+
+		f, err := os.Create(path)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if *format == "dot" {
+			err = fsm.WriteDot(f, opts)
+		} else {
+			err = fsm.WriteMermaid(f, opts)
+		}
+		if err == nil {
+			err = f.Close()
+		}
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+
+		fmt.Println(path)
+
+	}
+
+}
+
+func main() {
+
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "Usage: indfsm diagram [flags] file")
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "diagram":
+		diagram(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", os.Args[1])
+		os.Exit(2)
+	}
+
+}
@@ -0,0 +1,278 @@
+// Checks indicator files for problems.  Indicators which fail validation
+// are reported as errors, as are duplicate IDs and indicators which can
+// never hit.  Warnings are given for suspicious content: contradictions,
+// tautologies, duplicate terms, missing IDs, and descriptors which don't
+// match the indicator's terms.  Exits non-zero if any errors are found.
+//
+//	go run ./cmd/indlint [-json] indicators.json...
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	det "github.com/cybermaggedon/indicators"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// A problem found in an indicator file.
+type Finding struct {
+	File     string `json:"file"`
+	Severity string `json:"severity"`
+	Id       string `json:"id,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (f Finding) String() string {
+	s := f.File
+	if f.Path != "" {
+		s += ": " + f.Path
+	}
+	if f.Id != "" {
+		s += " (indicator " + f.Id + ")"
+	}
+	return s + ": " + f.Severity + ": " + f.Message
+}
+
+type linter struct {
+	file     string
+	findings []Finding
+}
+
+func (l *linter) report(severity, id, path, message string) {
+	l.findings = append(l.findings, Finding{
+		File:     l.file,
+		Severity: severity,
+		Id:       id,
+		Path:     path,
+		Message:  message,
+	})
+}
+
+// Returns a key which is equal for identical term trees.
+func key(t *det.Term) string {
+	data, _ := json.Marshal(t)
+	return string(data)
+}
+
+// Checks the children of an AND or OR term for duplicates, and for a term
+// appearing alongside its own negation.
+func (l *linter) checkChildren(id, path, name string, terms []*det.Term) {
+
+	seen := map[string]int{}
+	for i, t := range terms {
+		k := key(t)
+		if j, ok := seen[k]; ok {
+			l.report(severityWarning, id,
+				path+"."+name+"["+strconv.Itoa(i)+"]",
+				"duplicate of "+name+"["+strconv.Itoa(j)+"]")
+			continue
+		}
+		seen[k] = i
+	}
+
+	for i, t := range terms {
+		if t.Not == nil {
+			continue
+		}
+		j, ok := seen[key(t.Not)]
+		if !ok {
+			continue
+		}
+		msg := "contradiction: " + name + "[" + strconv.Itoa(j) +
+			"] and its negation can never both be true"
+		if name == "or" {
+			msg = "tautology: one of " + name + "[" +
+				strconv.Itoa(j) + "] and its negation is " +
+				"always true"
+		}
+		l.report(severityWarning, id,
+			path+"."+name+"["+strconv.Itoa(i)+"]", msg)
+	}
+
+}
+
+// Checks a term tree.
+func (l *linter) checkTerm(id, path string, t *det.Term) {
+
+	if t.IsAnd() {
+		l.checkChildren(id, path, "and", t.And)
+	}
+	if t.IsOr() {
+		l.checkChildren(id, path, "or", t.Or)
+	}
+
+	if t.Not != nil {
+		l.checkTerm(id, path+".not", t.Not)
+	}
+	children := []struct {
+		name  string
+		terms []*det.Term
+	}{
+		{"and", t.And}, {"or", t.Or}, {"of", t.Of},
+		{"sequence", t.Sequence},
+	}
+	for _, c := range children {
+		for i, v := range c.terms {
+			l.checkTerm(id, path+"."+c.name+"["+strconv.Itoa(i)+"]",
+				v)
+		}
+	}
+
+}
+
+// Returns true if the term tree has a match term which, not under a NOT,
+// agrees with the descriptor's type and value: the descriptor either
+// repeats the term, or is satisfied by it.
+func describes(t *det.Term, d det.Descriptor) bool {
+	if t.IsMatchTerm() {
+		if t.Type != d.Type {
+			return false
+		}
+		return d.Value == "" || d.Value == t.Value ||
+			t.Matches(det.Token{Type: d.Type, Value: d.Value})
+	}
+	for _, list := range [][]*det.Term{t.And, t.Or, t.Of, t.Sequence} {
+		for _, v := range list {
+			if describes(v, d) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checks an indicator's compiled FSM can reach 'hit'.
+func (l *linter) checkFsm(ind *det.Indicator, path string) {
+
+	fsm, err := ind.CompileFsm(&det.DefaultCompileOptions)
+	if err != nil {
+		l.report(severityWarning, ind.Id, path,
+			"not checked for hits: "+err.Error())
+		return
+	}
+
+	for _, v := range fsm.Transitions {
+		if v.Next == "hit" {
+			return
+		}
+	}
+
+	l.report(severityError, ind.Id, path, "can never hit")
+
+}
+
+func (l *linter) lint(data []byte) {
+
+	// Load indicators one at a time, so that each keeps its position in
+	// the file for reporting.
+	var raw struct {
+		Indicators []json.RawMessage `json:"indicators"`
+	}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		l.report(severityError, "", "", err.Error())
+		return
+	}
+
+	first := map[string]string{}
+	for i, r := range raw.Indicators {
+
+		path := "indicators[" + strconv.Itoa(i) + "]"
+
+		ii, err := det.LoadIndicators([]byte(`{"indicators":[` +
+			string(r) + `]}`))
+		if verr, ok := err.(*det.ValidationError); ok {
+			for _, p := range verr.Problems {
+				l.report(severityError, p.Id,
+					path+strings.TrimPrefix(p.Path,
+						"indicators[0]"), p.Message)
+			}
+			continue
+		}
+		if err != nil {
+			l.report(severityError, "", path, err.Error())
+			continue
+		}
+		ind := ii.Indicators[0]
+
+		// Indicators without IDs load, but hits on them can't be
+		// told apart.
+		if ind.Id == "" {
+			l.report(severityWarning, "", path, "missing id")
+		} else if p, ok := first[ind.Id]; ok {
+			l.report(severityError, ind.Id, path,
+				"duplicate id, also used at "+p)
+		} else {
+			first[ind.Id] = path
+		}
+
+		d := ind.Descriptor
+		if d.Type != "" && !describes(&ind.Term, d) {
+			l.report(severityWarning, ind.Id, path+".descriptor",
+				"descriptor type/value "+d.Type+":"+d.Value+
+					" doesn't match any term")
+		}
+
+		l.checkTerm(ind.Id, path, &ind.Term)
+		l.checkFsm(ind, path)
+
+	}
+
+}
+
+func main() {
+
+	asJson := flag.Bool("json", false, "output findings as JSON")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: indlint [-json] file...")
+		os.Exit(2)
+	}
+
+	findings := []Finding{}
+	for _, file := range flag.Args() {
+		l := linter{file: file}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			l.report(severityError, "", "", err.Error())
+		} else {
+			l.lint(data)
+		}
+		findings = append(findings, l.findings...)
+	}
+
+	errors := 0
+	for _, f := range findings {
+		if f.Severity == severityError {
+			errors++
+		}
+	}
+
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(findings)
+	} else {
+		for _, f := range findings {
+			fmt.Println(f)
+		}
+		fmt.Printf("%d findings, %d errors\n", len(findings), errors)
+	}
+
+	if errors > 0 {
+		os.Exit(1)
+	}
+
+}
@@ -14,7 +14,10 @@ func main() {
 		log.Fatalf("Error: %v", err)
 	}
 
-	fsmc := det.CreateFsmCollection(ii)
+	fsmc, err := det.CreateFsmCollection(ii)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
 
 	fsmc.Reset()
 	fsmc.Dump()
@@ -1,127 +1,598 @@
 // Detector library includes classes for loading indicators, building FSMs
 // from indicators, using FSMs to analyze terms and make hit decisions.
-// Call CreateFsmCollection to create a collection from indicators.  Call
-// Reset method to start scanning, Update methods with all tokens to scan,
-// and then GetHits to find out the indicators which hit.
+// Call CreateRuleset to compile indicators, and NewScanner on the result
+// to get a Scanner for each thing to be scanned.  Call Update on the
+// Scanner with all tokens to scan, and then GetHits to find out the
+// indicators which hit.  CreateFsmCollection wraps a Ruleset and a single
+// Scanner together.
 package indicators
 
 import (
+	"errors"
 	"fmt"
+	"time"
 )
 
-// A collection of indicators and derived FSMs.
-type FsmCollection struct {
+// A set of indicators compiled to FSMs.  A Ruleset is not modified once
+// created, so one Ruleset can be shared by any number of Scanners, and is
+// safe for concurrent use by multiple goroutines.
+type Ruleset struct {
+
+	// Array of all FSMs in compiled form.  An FSM's position in the
+	// array is its FSM ID.
+	Fsms []*StateTable
 
-	// Array of all FSMs
-	Fsms []*FsmMap
+	// Indicators, indexed by FSM ID.
+	Indicators []*Indicator
 
-	// Map from FSM to Indicator
-	Indicators map[*FsmMap]*Indicator
+	// Symbol IDs for all tokens which cause transitions in any FSM.
+	Symbols *SymbolTable
 
-	// Map from activator tokens to array of FSMs.  The tokens include
-	// all tokens which lead out of the 'init' state for each FSM.  By
+	// Activator FSMs, indexed by symbol ID.  For each symbol, lists the
+	// IDs of FSMs which the symbol takes out of the 'init' state.  By
 	// 'active', I'm refering to any FSM which has left the 'init'
 	// state.
-	Activators map[Token][]*FsmMap
+	Activators [][]int32
+
+	// Indicators which were left out because they exceeded the
+	// compilation limits, when CompileOptions.SkipComplex is set.
+	Skipped []*ComplexityError
+
+	// Time windows, indexed by FSM ID.  Zero for FSMs with no window.
+	Windows []time.Duration
+
+	// Product automata, when compiled with CompileOptions.Product.
+	Products []*Product
+
+	// For each FSM ID, the index of the Product the FSM is a member of,
+	// or -1 if it runs separately.  Nil if there are no products.
+	Grouped []int32
+
+	// Activator products, indexed by symbol ID, as for Activators.
+	ProductActivators [][]int32
+
+	// Total FSM sizes before and after minimisation.  Not saved, so
+	// zero for a loaded Ruleset.
+	Stats MinimiseStats
+
+	// The options the FSMs were compiled with.
+	Options CompileOptions
+
+	// Index of match terms which aren't exact matches.
+	matchers matchIndex
+
+	// Normalisers by token type, copied from those registered when the
+	// Ruleset was created or loaded, so that scanning needn't lock the
+	// registry.
+	normalisers map[string]Normaliser
+
+	// Compound symbols, by the symbols of their components in tokenLess
+	// order, see appendKey.
+	compounds map[string]int32
+
+	// Component symbols of each compound symbol, indexed by symbol ID.
+	// Nil for other symbols.
+	compoundParts [][]int32
+
+	// FSMs which a compound symbol takes out of the 'init' state,
+	// indexed by the symbols of its components.
+	compoundActivators [][]int32
+
+	// True if any FSM has a time window.
+	windowed bool
+}
+
+// Scanning state for one thing being scanned e.g. a network flow.  A
+// Scanner is cheap to create, and holds only the state of the FSMs it has
+// activated; the FSMs themselves belong to the Ruleset.  A Scanner must
+// not be used by more than one goroutine at a time, but any number of
+// Scanners on the same Ruleset can be used concurrently.
+type Scanner struct {
+
+	// The Ruleset being scanned for.
+	Ruleset *Ruleset
+
+	// The current state of all active FSMs, maps FSM ID to state ID.
+	// FSMs which are members of a product are not included.
+	State map[int32]int32
+
+	// The current state of all active products, maps product index to
+	// product state.
+	ProductState map[int32]int32
+
+	// FSMs dropped from the active set, in 'fail' or, if DropHits is
+	// set, in 'hit' with no way out.  Maps FSM ID to state ID.  Dropped
+	// FSMs are not activated again.
+	Done map[int32]int32
+
+	// If set, FSMs which reach a 'hit' state they can never leave are
+	// moved from State to Done, so that they are no longer stepped.
+	// 'fail' FSMs are always dropped.
+	DropHits bool
+
+	// Counts of FSM activity.
+	ScanStats ScanStats
+
+	// Products dropped from the active set.
+	doneProducts map[int32]bool
+
+	// For active FSMs with a time window, the time each FSM left the
+	// 'init' state.
+	Started map[int32]time.Time
+
+	// For active FSMs with a time window, the symbols applied since
+	// each FSM left the 'init' state, so that its progress can be
+	// rebuilt from the newest evidence when older evidence expires.
+	events map[int32][]windowEvent
+
+	// Occurrences so far of match terms with a count, maps symbol ID
+	// to count.  A term's symbol is only applied to the FSMs once its
+	// count is reached.  Counts are for the whole scan, since the
+	// Scanner was created or last Reset, not for each FSM.
+	Counts map[int32]int
+
+	// Returns the time of tokens passed to Update.  Defaults to
+	// time.Now, and can be replaced e.g. to scan recorded data.
+	Clock func() time.Time
+
+	// Called for each indicator hit as it happens, if set.
+	OnHit HitHandler
+
+	// If set, the path each FSM takes is recorded, so that
+	// ExplainHits can explain hits.
+	Explain bool
+
+	// Transitions taken by each active FSM, when Explain is set.
+	paths map[int32][]pathStep
+
+	// Number of tokens passed to Update since the Scanner was created
+	// or last Reset.
+	Sequence uint64
+
+	// Buffer for symbols resolved from a token.
+	syms []int32
+
+	// FSMs which hit on the current token.
+	hits []int32
 
-	// The current state of all active FSMs, maps FSM to the current
-	// state string.
-	State map[*FsmMap]string
+	// FSMs in hits which hit when their window's evidence was replayed,
+	// with the evidence which made them hit.
+	replayed map[int32]windowEvent
+
+	// The token being applied.
+	token Token
 }
 
-// Dump an FSM collection showing all tracked states.
-func (c *FsmCollection) Dump() {
+// A collection of indicators and derived FSMs, combining a Ruleset with a
+// single Scanner.
+type FsmCollection struct {
+	*Ruleset
+	*Scanner
+}
+
+// Creates a new Scanner, with all FSMs inactive.
+func (r *Ruleset) NewScanner() *Scanner {
+	return &Scanner{
+		Ruleset:      r,
+		State:        map[int32]int32{},
+		ProductState: map[int32]int32{},
+		Done:         map[int32]int32{},
+		Started:      map[int32]time.Time{},
+		events:       map[int32][]windowEvent{},
+		replayed:     map[int32]windowEvent{},
+		Counts:       map[int32]int{},
+		paths:        map[int32][]pathStep{},
+		doneProducts: map[int32]bool{},
+		Clock:        time.Now,
+	}
+}
+
+// Dump a Scanner showing all tracked states.
+func (s *Scanner) Dump() {
 	fmt.Println("State:")
-	for fsm, state := range c.State {
-		fmt.Println("  ", c.Indicators[fsm].Id, " in state ", state)
+	s.eachState(func(fsm, state int32) {
+		fmt.Println("  ", s.Ruleset.Indicators[fsm].Id, " in state ",
+			s.Ruleset.Fsms[fsm].States[state])
+	})
+	if len(s.Counts) > 0 {
+		fmt.Println("Counts:")
+		for sym, count := range s.Counts {
+			token := s.Ruleset.Symbols.Tokens[sym]
+			fmt.Println("  ", token, " seen ", count)
+		}
 	}
 }
 
-// Resets an FSM collection so that all FSMs revert to the inactive state.
-// This would be called to forget existing scanning history when scanning
+// Resets a Scanner so that all FSMs revert to the inactive state.  This
+// would be called to forget existing scanning history when scanning
 // something new.
-func (c *FsmCollection) Reset() {
-	c.State = map[*FsmMap]string{}
+func (s *Scanner) Reset() {
+	s.State = map[int32]int32{}
+	s.ProductState = map[int32]int32{}
+	s.Done = map[int32]int32{}
+	s.Started = map[int32]time.Time{}
+	s.events = map[int32][]windowEvent{}
+	s.Counts = map[int32]int{}
+	s.paths = map[int32][]pathStep{}
+	s.doneProducts = map[int32]bool{}
+	s.ScanStats = ScanStats{}
+	s.Sequence = 0
+}
+
+// Update a Scanner for a new token.  Each match term the token satisfies
+// is applied to the FSMs in turn.  If any indicator has a time window, the
+// token is timed using the Scanner's Clock.
+func (s *Scanner) Update(token Token) {
+	var at time.Time
+	if s.Ruleset.windowed {
+		at = s.Clock()
+	}
+	s.UpdateAt(token, at)
+}
+
+// Update a Scanner for a new token observed at the given time.  Tokens
+// must be passed in time order.  The time only matters for indicators
+// with a time window.
+func (s *Scanner) UpdateAt(token Token, at time.Time) {
+
+	s.Sequence++
+	s.token = token
+
+	if s.Ruleset.windowed {
+		s.expire(at)
+	}
+
+	s.syms = s.Ruleset.Resolve(token, s.syms[:0])
+
+	// Terms with a count only take effect once the count is reached.
+	// The count stops there, as the term is true from then on.
+	syms := s.syms[:0]
+	for _, sym := range s.syms {
+		if count := s.Ruleset.Symbols.Tokens[sym].Count; count > 1 {
+			if s.Counts[sym] < count {
+				s.Counts[sym]++
+			}
+			if s.Counts[sym] < count {
+				continue
+			}
+		}
+		syms = append(syms, sym)
+	}
+
+	switch len(syms) {
+	case 0:
+	case 1:
+		s.step(syms[0], at)
+	default:
+		s.stepAll(syms, at)
+	}
+
+	if len(s.hits) > 0 {
+		s.notify(token)
+	}
+
 }
 
-// Update an FSM collection for a new token.
-func (c *FsmCollection) Update(token Token) {
+// Update a Scanner for a symbol.
+func (s *Scanner) step(sym int32, at time.Time) {
 
-	// If the token is an activator, activate all relevant FSMs to the
+	// If the symbol is an activator, activate all relevant FSMs to the
 	// init state.  The next code segment will apply the transition from
 	// init to the next state.
-	if fsms, ok := c.Activators[token]; ok {
-		for _, fsm := range fsms {
-			if _, ok = c.State[fsm]; !ok {
-				c.State[fsm] = "init"
+	for _, fsm := range s.Ruleset.Activators[sym] {
+		s.activate(fsm, at)
+	}
+
+	// Iterate over all active FSMs, moving to the next state if necessary.
+	// FSMs which can go no further are dropped from the active set.
+	for fsm, state := range s.State {
+		s.advance(fsm, state, sym, at)
+	}
+
+	if len(s.Ruleset.Products) > 0 {
+		s.stepProducts(sym)
+	}
+
+	if n := s.Active(); n > s.ScanStats.MaxActive {
+		s.ScanStats.MaxActive = n
+	}
+
+}
+
+// Update a Scanner for a token which satisfies the match terms of several
+// symbols, in tokenLess order.  Each FSM takes one transition, on the
+// symbol of the one term it has among them, or the compound symbol of
+// the several it has, so that the terms are applied together.  FSMs in
+// products never have more than one.
+func (s *Scanner) stepAll(syms []int32, at time.Time) {
+
+	r := s.Ruleset
+
+	for _, sym := range syms {
+		for _, fsms := range [][]int32{r.Activators[sym],
+			r.compoundActivators[sym]} {
+			for _, fsm := range fsms {
+				own, ok := r.symbolFor(fsm, syms)
+				if !ok {
+					continue
+				}
+				if _, ok := r.Fsms[fsm].Step(StateInit, own); ok {
+					s.activate(fsm, at)
+				}
 			}
 		}
 	}
 
-	// Iterate over all active FSMs, moving to the next state if necessary.
-	for fsm, state := range c.State {
-		event := FsmEvent{State: state, Token: token}
-		if newstate, ok := (*fsm)[event]; ok {
-			c.State[fsm] = newstate
+	for fsm, state := range s.State {
+		if own, ok := r.symbolFor(fsm, syms); ok {
+			s.advance(fsm, state, own, at)
+		} else {
+			s.ScanStats.Steps++
 		}
 	}
 
+	if len(r.Products) > 0 {
+		for _, sym := range syms {
+			s.stepProducts(sym)
+		}
+	}
+
+	if n := s.Active(); n > s.ScanStats.MaxActive {
+		s.ScanStats.MaxActive = n
+	}
+
+}
+
+// Activates an FSM to the init state, unless it is active already or has
+// been dropped.
+func (s *Scanner) activate(fsm int32, at time.Time) {
+	if _, ok := s.State[fsm]; ok {
+		return
+	}
+	if _, ok := s.Done[fsm]; ok {
+		return
+	}
+	s.State[fsm] = StateInit
+	s.ScanStats.Activated++
+	if s.Ruleset.windowed && s.Ruleset.Windows[fsm] > 0 {
+		s.Started[fsm] = at
+	}
+}
+
+// Applies a symbol to an active FSM.
+func (s *Scanner) advance(fsm, state, sym int32, at time.Time) {
+	s.ScanStats.Steps++
+	if s.Ruleset.windowed && s.Ruleset.Windows[fsm] > 0 {
+		s.remember(fsm, sym, at)
+	}
+	if next, ok := s.Ruleset.Fsms[fsm].Step(state, sym); ok {
+		s.record(fsm, state, sym, next)
+		s.State[fsm] = next
+		if next == StateHit {
+			s.hits = append(s.hits, fsm)
+		}
+		s.drop(fsm, next)
+	}
 }
 
-// Returns all active FSM hits.  This would be called once scanning is
-// complete to return hits.
-func (c *FsmCollection) GetHits() []*Indicator {
+// Returns the symbol an FSM sees for a token satisfying the match terms
+// of syms, which are in tokenLess order: the one of them which is the
+// FSM's, or the compound symbol for several.  Returns false if none of
+// them are the FSM's.
+func (r *Ruleset) symbolFor(fsm int32, syms []int32) (int32, bool) {
 
-	hits := []*Indicator{}
+	t := r.Fsms[fsm]
+	own := int32(-1)
+	n := 0
+	var key []byte
 
-	for fsm, state := range c.State {
-		if state == "hit" {
-			hits = append(hits, c.Indicators[fsm])
+	for _, sym := range syms {
+		if !t.HasTerm(sym) {
+			continue
 		}
+		if n == 1 {
+			key = appendKey(key, own)
+		}
+		if n > 0 {
+			key = appendKey(key, sym)
+		}
+		own = sym
+		n++
 	}
 
-	return hits
+	switch n {
+	case 0:
+		return -1, false
+	case 1:
+		return own, true
+	}
+	sym, ok := r.compounds[string(key)]
+	return sym, ok
 
 }
 
-// Create an FSM collection from a set of indicators.
-func CreateFsmCollection(ii *Indicators) *FsmCollection {
+// Appends a component symbol to the key of a compound symbol, see
+// Ruleset.compounds.
+func appendKey(key []byte, sym int32) []byte {
+	return append(key, byte(sym>>24), byte(sym>>16), byte(sym>>8),
+		byte(sym))
+}
 
-	// Initialise the FSM collection to null state, and allocate all maps.
-	fsmc := FsmCollection{}
-	fsmc.Indicators = map[*FsmMap]*Indicator{}
-	fsmc.Activators = map[Token][]*FsmMap{}
-	fsmc.State = map[*FsmMap]string{}
+// Returns all active FSM hits, in the order the indicators were loaded.
+// This would be called once scanning is complete to return hits.  See
+// GetHitsWith for other orders and de-duplication.
+func (s *Scanner) GetHits() []*Indicator {
+	return s.GetHitsWith(nil)
+}
+
+// Compile a set of indicators to a Ruleset.  If an indicator exceeds the
+// limits in opts, a *ComplexityError is returned, unless opts.SkipComplex
+// is set in which case the indicator is left out and recorded in the
+// Ruleset's Skipped list.  opts may be nil, meaning no limits.
+func CreateRuleset(ii *Indicators, opts *CompileOptions) (*Ruleset, error) {
+
+	if opts == nil {
+		opts = &CompileOptions{}
+	}
+
+	// Initialise the Ruleset to null state.
+	r := Ruleset{Symbols: NewSymbolTable(), Options: *opts}
 
 	// Iterate over indicators
 	for _, ind := range ii.Indicators {
 
-		// Generate the FSM for this indicator.
-		fsm := ind.GenerateFsm()
+		// Trees which haven't been through LoadIndicators may be
+		// malformed.
+		if ind == nil {
+			return nil, errors.New("missing indicator")
+		}
+		err := ind.Check()
+		if err != nil {
+			return nil, fmt.Errorf("indicator %s: %v", ind.Id, err)
+		}
 
-		// Convert the FSM to its 'map' form.
-		fsmm := fsm.Mapify()
+		// Generate the FSM for this indicator.  Only reachable states
+		// are explored, which helps where NOT, OR and thresholds rule
+		// out combinations, but every subset of a plain AND's
+		// children is reachable, so a wide AND is still exponential
+		// and is caught by the limits in opts.
+		fsm, err := ind.CompileFsm(opts)
+		if err != nil {
+			cerr, ok := err.(*ComplexityError)
+			if ok && opts.SkipComplex {
+				r.Skipped = append(r.Skipped, cerr)
+				continue
+			}
+			return nil, err
+		}
+
+		// Convert the FSM to its compiled form, and add it to the
+		// FSM list along with its indicator.
+		r.Fsms = append(r.Fsms, fsm.Tabulate(r.Symbols))
+		r.Stats.Add(fsm.Minimised)
+		r.Indicators = append(r.Indicators, ind)
 
-		// Add mapping from FSM to corresponding indicator.
-		fsmc.Indicators[fsmm] = ind
+	}
+
+	err := r.index()
+	if err != nil {
+		return nil, err
+	}
 
-		// Get activator terms
-		activs := fsm.GetActivators()
+	if opts.Product {
+		r.buildProducts(opts)
+	}
+
+	return &r, nil
+
+}
+
+// Builds product automata with the limits in opts, see BuildProducts.
+func (r *Ruleset) buildProducts(opts *CompileOptions) {
+	maxStates, maxMembers := opts.MaxProductStates, opts.MaxProductMembers
+	if maxStates <= 0 {
+		maxStates = DefaultCompileOptions.MaxProductStates
+	}
+	if maxMembers <= 0 {
+		maxMembers = DefaultCompileOptions.MaxProductMembers
+	}
+	r.BuildProducts(maxStates, maxMembers)
+}
+
+// Builds all indexes derived from the FSMs, symbols and indicators, and
+// takes a copy of the registered normalisers.
+func (r *Ruleset) index() error {
+	r.normalisers = registeredNormalisers()
+	err := r.IndexCompounds()
+	if err != nil {
+		return err
+	}
+	r.IndexActivators()
+	err = r.IndexWindows()
+	if err != nil {
+		return err
+	}
+	return r.IndexMatchers()
+}
 
-		// Add activator terms to the activator map.
-		for _, activ := range activs {
-			if _, ok := fsmc.Activators[activ]; !ok {
-				fsmc.Activators[activ] = nil
+// Builds the index of compound symbols from the symbol table.  Call
+// before IndexActivators.
+func (r *Ruleset) IndexCompounds() error {
+	r.compounds = map[string]int32{}
+	r.compoundParts = make([][]int32, len(r.Symbols.Tokens))
+	for sym, token := range r.Symbols.Tokens {
+		if token.Match != matchCompound {
+			continue
+		}
+		parts, err := token.components()
+		if err != nil {
+			return err
+		}
+		syms := []int32{}
+		for _, part := range parts {
+			id, ok := r.Symbols.Lookup(part)
+			if !ok {
+				return fmt.Errorf("compound token %s: no "+
+					"symbol for %s", token, part)
 			}
-			fsmc.Activators[activ] = append(fsmc.Activators[activ],
-				fsmm)
+			syms = append(syms, id)
+		}
+		var key []byte
+		for _, id := range syms {
+			key = appendKey(key, id)
+		}
+		r.compounds[string(key)] = int32(sym)
+		r.compoundParts[sym] = syms
+	}
+	return nil
+}
+
+// Builds the Activators index from the FSMs, and the ProductActivators
+// index from the products.  FSMs which a compound symbol activates are
+// also indexed by its components, see IndexCompounds.
+func (r *Ruleset) IndexActivators() {
+	r.Activators = make([][]int32, len(r.Symbols.Tokens))
+	r.ProductActivators = make([][]int32, len(r.Symbols.Tokens))
+	for id, p := range r.Products {
+		for _, sym := range p.Table.Activators() {
+			r.ProductActivators[sym] = append(
+				r.ProductActivators[sym], int32(id))
+		}
+	}
+	for fsm, t := range r.Fsms {
+		if r.Grouped != nil && r.Grouped[fsm] >= 0 {
+			continue
+		}
+		for _, sym := range t.Activators() {
+			r.Activators[sym] = append(r.Activators[sym],
+				int32(fsm))
+		}
+	}
+	r.compoundActivators = make([][]int32, len(r.Symbols.Tokens))
+	for sym, parts := range r.compoundParts {
+		for _, part := range parts {
+			r.compoundActivators[part] = append(
+				r.compoundActivators[part],
+				r.Activators[sym]...)
 		}
+	}
+}
+
+// Create an FSM collection from a set of indicators, using the default
+// compilation options.
+func CreateFsmCollection(ii *Indicators) (*FsmCollection, error) {
+	return CreateFsmCollectionWithOptions(ii, &DefaultCompileOptions)
+}
 
-		// Append FSM to FSM list.
-		fsmc.Fsms = append(fsmc.Fsms, fsmm)
+// Create an FSM collection from a set of indicators.  Compilation is as
+// for CreateRuleset.
+func CreateFsmCollectionWithOptions(ii *Indicators, opts *CompileOptions) (*FsmCollection, error) {
 
+	r, err := CreateRuleset(ii, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	return &fsmc
+	return &FsmCollection{Ruleset: r, Scanner: r.NewScanner()}, nil
 
 }
@@ -0,0 +1,151 @@
+package indicators
+
+import (
+	"sync"
+	"testing"
+)
+
+// Many concurrent Scanners share one Ruleset, and each sees only its own
+// hits.  Run with -race.
+func TestConcurrentSessions(t *testing.T) {
+
+	ii, err := LoadIndicatorsFromFile("ind3.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := CreateRuleset(ii, &DefaultCompileOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sessions alternate between a token stream which hits the URL
+	// indicator, and one which is vetoed by a port in the NOT clause.
+	hitting := []Token{
+		{Type: "tcp", Value: "80"},
+		{Type: "url", Value: "http://www.example.com/malware.dat"},
+		EndToken,
+	}
+	vetoed := []Token{
+		{Type: "tcp", Value: "80"},
+		{Type: "tcp", Value: "8081"},
+		{Type: "url", Value: "http://www.example.com/malware.dat"},
+		EndToken,
+	}
+
+	sessions, workers := 5000, 64
+	if testing.Short() {
+		sessions = 500
+	}
+
+	var wg sync.WaitGroup
+	work := make(chan int)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range work {
+
+				tokens, expect := hitting, 1
+				if id%2 == 1 {
+					tokens, expect = vetoed, 0
+				}
+
+				s := rs.NewScanner()
+
+				// Re-use the Scanner for a second pass, to
+				// check Reset forgets the first.
+				for pass := 0; pass < 2; pass++ {
+					s.Reset()
+					for _, tok := range tokens {
+						s.Update(tok)
+					}
+					if got := len(s.GetHits()); got != expect {
+						t.Errorf("session %d pass %d: %d "+
+							"hits, expected %d", id, pass,
+							got, expect)
+					}
+				}
+
+			}
+		}()
+	}
+
+	for id := 0; id < sessions; id++ {
+		work <- id
+	}
+	close(work)
+	wg.Wait()
+
+}
+
+// Occurrences are counted for the whole scan, including those before the
+// indicator's FSM leaves 'init'.
+func TestCountsAreScanWide(t *testing.T) {
+
+	ii, err := LoadIndicators([]byte(`{
+  "indicators": [
+    {
+      "id": "brute-force",
+      "sequence": [
+        { "type": "event", "value": "start" },
+        { "type": "event", "value": "login-failed", "count": 3 }
+      ]
+    }
+  ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := CreateRuleset(ii, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := rs.NewScanner()
+	for _, token := range []string{"event:login-failed",
+		"event:login-failed", "event:start", "event:login-failed"} {
+		s.Update(parseToken(token))
+	}
+	if len(s.GetHits()) != 1 {
+		t.Errorf("expected occurrences before activation to count")
+	}
+
+	s.Reset()
+	s.Update(parseToken("event:start"))
+	s.Update(parseToken("event:login-failed"))
+	if len(s.GetHits()) != 0 || len(s.Counts) != 1 {
+		t.Errorf("expected Reset to clear counts")
+	}
+
+}
+
+// An FsmCollection's fields aren't ambiguous between its Ruleset and its
+// Scanner.
+func TestFsmCollectionFields(t *testing.T) {
+
+	ii, err := LoadIndicators([]byte(activeIndicators))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := CompileOptions{Product: true}
+	fsmc, err := CreateFsmCollectionWithOptions(ii, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsmc.Update(Token{Type: "t", Value: "a"})
+
+	if len(fsmc.Products) == 0 ||
+		len(fsmc.Products) != len(fsmc.Ruleset.Products) {
+		t.Errorf("expected the Ruleset's products, got %d",
+			len(fsmc.Products))
+	}
+	if len(fsmc.ProductState) == 0 {
+		t.Error("no active products")
+	}
+	if fsmc.Stats.StatesAfter == 0 ||
+		fsmc.ScanStats.Activated == 0 {
+		t.Errorf("wrong stats %v, %v", fsmc.Stats, fsmc.ScanStats)
+	}
+
+}
@@ -0,0 +1,125 @@
+package indicators
+
+import (
+	"fmt"
+	"time"
+)
+
+// Options controlling compilation of indicators to FSMs.  A zero limit
+// means no limit.
+type CompileOptions struct {
+
+	// Maximum number of states, excluding 'hit' and 'fail', in the FSM
+	// for a single indicator.
+	MaxStates int
+
+	// Maximum number of transitions in the FSM for a single indicator.
+	MaxTransitions int
+
+	// Maximum time to spend compiling a single indicator, covering every
+	// stage of CompileFsm.
+	MaxTime time.Duration
+
+	// Maximum size of the compiled state table for a single indicator,
+	// in cells: states multiplied by distinct symbols.
+	MaxTableSize int
+
+	// If true, indicators which exceed a limit are left out of the
+	// collection and reported in its Skipped list, rather than failing
+	// the whole collection.
+	SkipComplex bool
+
+	// If true, FSMs which share activators are combined into product
+	// automata, see Ruleset.BuildProducts.
+	Product bool
+
+	// Maximum number of states in a product automaton.  Zero means the
+	// default.
+	MaxProductStates int
+
+	// Maximum number of FSMs combined into one product automaton.  Zero
+	// means the default.
+	MaxProductMembers int
+}
+
+// Default compilation options used by CreateFsmCollection.  The limits
+// are generous, and are there to stop a pathological indicator from
+// consuming all available memory.
+var DefaultCompileOptions = CompileOptions{
+	MaxStates:      1 << 16,
+	MaxTransitions: 1 << 20,
+	MaxTableSize:   1 << 24,
+	MaxTime:        time.Minute,
+
+	MaxProductStates:  1 << 12,
+	MaxProductMembers: 16,
+}
+
+// Returns the options which affect the FSMs compiled for each indicator,
+// with those for product automata cleared.
+func (o CompileOptions) fsmOptions() CompileOptions {
+	o.Product = false
+	o.MaxProductStates = 0
+	o.MaxProductMembers = 0
+	return o
+}
+
+// Returns a function which reports whether the time budget in opts,
+// starting now, has run out.  opts may be nil, meaning no limit.
+func timeBudget(opts *CompileOptions) func() bool {
+	if opts == nil || opts.MaxTime <= 0 {
+		return func() bool { return false }
+	}
+	deadline := time.Now().Add(opts.MaxTime)
+	return func() bool {
+		return time.Now().After(deadline)
+	}
+}
+
+// Describes an indicator which is too complex to compile within the
+// limits in CompileOptions.
+type ComplexityError struct {
+
+	// ID of the offending indicator.
+	Id string
+
+	// The limit which was hit: "states", "transitions", "table"
+	// or "time".
+	Limit string
+
+	// The value of the limit.  Time is in milliseconds.
+	Max int64
+
+	// Number of nodes in the indicator's term tree.
+	TreeSize int
+}
+
+func (e *ComplexityError) Error() string {
+	return fmt.Sprintf("indicator %s too complex: exceeds %s limit of %d "+
+		"(term tree has %d nodes)", e.Id, e.Limit, e.Max, e.TreeSize)
+}
+
+// Creates a ComplexityError for this indicator.
+func (i *Indicator) complexityError(limit string, max int64) *ComplexityError {
+	return &ComplexityError{
+		Id:       i.Id,
+		Limit:    limit,
+		Max:      max,
+		TreeSize: i.root().TreeSize(),
+	}
+}
+
+// Returns the number of nodes in a term tree.
+func (l *Term) TreeSize() int {
+	size := 0
+	l.Walk(func(*Term, interface{}, *Term) error {
+		size++
+		return nil
+	})
+	return size
+}
+
+// Creates a ComplexityError for an indicator which ran out of time.
+func (i *Indicator) timeError(opts *CompileOptions) *ComplexityError {
+	return i.complexityError("time", int64(opts.MaxTime/time.Millisecond))
+}
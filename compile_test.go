@@ -0,0 +1,172 @@
+package indicators
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Returns an indicator which is an AND of n distinct tokens.
+func wideAnd(n int) *Indicator {
+	and := []*Term{}
+	for i := 0; i < n; i++ {
+		and = append(and, &Term{Type: "t", Value: strconv.Itoa(i)})
+	}
+	return &Indicator{Id: "wide", Term: Term{And: and}}
+}
+
+func TestCompileTimeLimit(t *testing.T) {
+
+	opts := DefaultCompileOptions
+	opts.MaxTime = time.Millisecond
+
+	_, err := wideAnd(12).CompileFsm(&opts)
+	var ce *ComplexityError
+	if !errors.As(err, &ce) || ce.Limit != "time" {
+		t.Fatalf("expected time limit error, got %v", err)
+	}
+
+}
+
+// The stages after exploring states must give up when the budget has run
+// out, not just exploration.
+func TestCompileStagesBudgeted(t *testing.T) {
+
+	ind := wideAnd(8)
+	n := ind.BuildNavigator()
+	never := func() bool { return false }
+	always := func() bool { return true }
+
+	fsm, err := ind.exploreTransitions(n.Terms, n, nil, never)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsm.Flatten()
+
+	if fsm.removeInvalidTransitions(always) {
+		t.Error("removeInvalidTransitions ignored the time budget")
+	}
+	if _, ok := fsm.minimise(always); ok {
+		t.Error("minimise ignored the time budget")
+	}
+
+	// Both leave the FSM usable, so compilation can carry on.
+	if !fsm.removeInvalidTransitions(never) {
+		t.Fatal("removeInvalidTransitions gave up without a budget")
+	}
+	if _, ok := fsm.minimise(never); !ok {
+		t.Fatal("minimise gave up without a budget")
+	}
+
+}
+
+func TestCompileWithinTime(t *testing.T) {
+
+	opts := DefaultCompileOptions
+	fsm, err := wideAnd(8).CompileFsm(&opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if states, _ := fsm.size(); states != 1<<8+1 {
+		t.Errorf("expected %d states, got %d", 1<<8+1, states)
+	}
+
+}
+
+// Returns an indicator which is true when at least k of n distinct tokens
+// are seen.
+func threshold(k, n int) *Indicator {
+	ind := wideAnd(n)
+	ind.Term = Term{AtLeast: k, Of: ind.Term.And}
+	return ind
+}
+
+// A threshold's states record which of its terms are true, not just how
+// many, as a repeated token mustn't count twice.
+func TestThresholdStates(t *testing.T) {
+
+	ind := threshold(3, 8)
+	fsm, err := ind.CompileFsm(&DefaultCompileOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Subsets of fewer than 3 of the 8 terms, plus 'hit' and 'fail'.
+	if states, _ := fsm.size(); states != 1+8+28+2 {
+		t.Errorf("expected %d states, got %d", 1+8+28+2, states)
+	}
+
+	rs := ruleset(ind, fsm)
+	t0 := Token{Type: "t", Value: "0"}
+	t1 := Token{Type: "t", Value: "1"}
+	if scanHits(rs, []Token{t0, t0, t1, t1, EndToken}) {
+		t.Error("repeated tokens counted twice")
+	}
+	t2 := Token{Type: "t", Value: "2"}
+	if !scanHits(rs, []Token{t0, t0, t1, t2, EndToken}) {
+		t.Error("threshold not reached")
+	}
+
+}
+
+// A wide threshold compiles within the default limits as long as the
+// subsets of fewer than AtLeast terms are few enough: 3 of 12 needs 79
+// states, where 8 of 24 would need over half a million.
+func TestWideThreshold(t *testing.T) {
+
+	fsm, err := threshold(3, 12).CompileFsm(&DefaultCompileOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if states, _ := fsm.size(); states != 1+12+66+2 {
+		t.Errorf("expected %d states, got %d", 1+12+66+2, states)
+	}
+
+}
+
+// With SkipComplex, an indicator over a limit is left out of the Ruleset
+// and listed in Skipped, and the rest still scan.
+func TestSkipComplex(t *testing.T) {
+
+	ii := &Indicators{}
+	ii.Add(&Indicator{Id: "simple", Term: Term{Type: "t", Value: "0"}})
+	ii.Add(wideAnd(8))
+	ii.Add(&Indicator{Id: "pair", Term: Term{And: []*Term{
+		{Type: "t", Value: "0"}, {Type: "t", Value: "1"}}}})
+	if err := ii.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultCompileOptions
+	opts.MaxStates = 100
+	if _, err := CreateRuleset(ii, &opts); err == nil {
+		t.Fatal("indicator over the limit compiled")
+	}
+
+	opts.SkipComplex = true
+	rs, err := CreateRuleset(ii, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.Skipped) != 1 || rs.Skipped[0].Id != "wide" ||
+		rs.Skipped[0].Limit != "states" {
+		t.Fatalf("wrong skipped list %v", rs.Skipped)
+	}
+	if len(rs.Indicators) != 2 {
+		t.Errorf("expected 2 indicators, got %d", len(rs.Indicators))
+	}
+
+	s := rs.NewScanner()
+	for i := 0; i < 8; i++ {
+		s.Update(Token{Type: "t", Value: strconv.Itoa(i)})
+	}
+	ids := []string{}
+	for _, ind := range s.GetHits() {
+		ids = append(ids, ind.Id)
+	}
+	if len(ids) != 2 || ids[0] != "simple" || ids[1] != "pair" {
+		t.Errorf("expected simple and pair to hit, got %v", ids)
+	}
+
+}
@@ -0,0 +1,254 @@
+package indicators
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Options for rendering an FSM as a diagram.
+type DiagramOptions struct {
+
+	// Title of the diagram, typically the indicator ID.
+	Title string
+
+	// If set, each state is annotated with the terms it represents,
+	// looked up in the Navigator the FSM was built with.
+	Navigator *Navigator
+}
+
+// An edge of a diagram: all tokens taking one state to another.
+type diagramEdge struct {
+	from, to string
+	tokens   []string
+}
+
+// Returns the states and edges of an FSM in a stable order.  'init' comes
+// first, then other states in sort order, then 'hit' and 'fail'.
+func (fsm *Fsm) diagram() ([]string, []diagramEdge) {
+
+	tokens := map[[2]string][]Token{}
+	seen := map[string]bool{"init": true}
+	states := []string{"init"}
+	for _, v := range fsm.Transitions {
+		key := [2]string{v.Current, v.Next}
+		tokens[key] = append(tokens[key], v.Token...)
+		for _, name := range key {
+			if !seen[name] {
+				seen[name] = true
+				states = append(states, name)
+			}
+		}
+	}
+
+	rank := func(name string) int {
+		switch name {
+		case "init":
+			return 0
+		case "hit":
+			return 2
+		case "fail":
+			return 3
+		}
+		return 1
+	}
+	sort.Slice(states, func(a, b int) bool {
+		ra, rb := rank(states[a]), rank(states[b])
+		if ra != rb {
+			return ra < rb
+		}
+		return states[a] < states[b]
+	})
+	order := map[string]int{}
+	for i, name := range states {
+		order[name] = i
+	}
+
+	edges := []diagramEdge{}
+	for key, list := range tokens {
+		sort.Slice(list, func(a, b int) bool {
+			return tokenLess(list[a], list[b])
+		})
+		e := diagramEdge{from: key[0], to: key[1]}
+		for _, token := range list {
+			e.tokens = append(e.tokens, token.String())
+		}
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(a, b int) bool {
+		if edges[a].from != edges[b].from {
+			return order[edges[a].from] < order[edges[b].from]
+		}
+		return order[edges[a].to] < order[edges[b].to]
+	})
+
+	return states, edges
+
+}
+
+// Describes the terms a state represents e.g. "s2-5" -> ["s2: and",
+// "s5: ipv4:10.0.0.1"].  Only the terms in the state's name are described,
+// so for a minimised FSM, not those of states merged into it, see
+// Fsm.Merged.
+func (n *Navigator) DescribeState(state string) []string {
+
+	if !strings.HasPrefix(state, "s") {
+		return nil
+	}
+
+	desc := []string{}
+	for _, id := range strings.Split(state[1:], "-") {
+		name := "s" + id
+		l, ok := n.LogicState[name]
+		if !ok {
+			continue
+		}
+		desc = append(desc, name+": "+l.Describe())
+	}
+	return desc
+
+}
+
+// Returns a short description of a term, without its children.
+func (l *Term) Describe() string {
+	switch {
+	case l.IsMatchTerm():
+		return l.Token().String()
+	case l.IsAnd():
+		return "and"
+	case l.IsOr():
+		return "or"
+	case l.IsNot():
+		return "not"
+	case l.IsThreshold():
+		return fmt.Sprintf("at least %d of", l.AtLeast)
+	case l.IsSequence():
+		return "sequence"
+	}
+	return "empty"
+}
+
+// Returns the lines of a state's label: its name, then the terms it
+// represents if opts has a Navigator.  The terms are those of one of the
+// states minimisation merged, so the number of others is noted.
+func (fsm *Fsm) stateLabel(name string, opts *DiagramOptions) []string {
+	label := []string{name}
+	if opts.Navigator != nil {
+		label = append(label, opts.Navigator.DescribeState(name)...)
+	}
+	if n := len(fsm.Merged[name]); n > 0 {
+		label = append(label, fmt.Sprintf("(+%d merged states)", n))
+	}
+	return label
+}
+
+// Escapes a string for use in a DOT quoted string.
+func dotQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return `"` + s + `"`
+}
+
+// Writes an FSM as a Graphviz DOT digraph.  Edges are labelled with the
+// tokens which cause each transition.  'init' is drawn bold, 'hit' as a
+// green double circle and 'fail' as a red octagon.
+func (fsm *Fsm) WriteDot(w io.Writer, opts *DiagramOptions) error {
+
+	if opts == nil {
+		opts = &DiagramOptions{}
+	}
+	states, edges := fsm.diagram()
+
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, "digraph fsm {")
+	if opts.Title != "" {
+		fmt.Fprintf(bw, "  label=%s;\n  labelloc=t;\n",
+			dotQuote(opts.Title))
+	}
+	fmt.Fprintln(bw, "  rankdir=LR;")
+	fmt.Fprintln(bw, "  node [shape=ellipse];")
+
+	for _, name := range states {
+		label := strings.Join(fsm.stateLabel(name, opts), "\n")
+		attrs := "label=" + dotQuote(label)
+		switch name {
+		case "init":
+			attrs += ", shape=circle, style=bold"
+		case "hit":
+			attrs += ", shape=doublecircle, style=filled, " +
+				"fillcolor=palegreen"
+		case "fail":
+			attrs += ", shape=octagon, style=filled, " +
+				"fillcolor=lightpink"
+		}
+		fmt.Fprintf(bw, "  %s [%s];\n", dotQuote(name), attrs)
+	}
+
+	for _, e := range edges {
+		fmt.Fprintf(bw, "  %s -> %s [label=%s];\n", dotQuote(e.from),
+			dotQuote(e.to), dotQuote(strings.Join(e.tokens, "\n")))
+	}
+
+	fmt.Fprintln(bw, "}")
+
+	return bw.Flush()
+
+}
+
+// Converts a state name to a Mermaid state ID, which can't contain '-'.
+func mermaidId(name string) string {
+	return strings.Replace(name, "-", "_", -1)
+}
+
+// Escapes text for use in a Mermaid label.
+func mermaidText(s string) string {
+	return strings.Replace(s, `"`, "#quot;", -1)
+}
+
+// Writes an FSM as a Mermaid state diagram.  Edges are labelled with the
+// tokens which cause each transition.  'init' is entered from the start
+// marker and drawn bold, and 'hit' and 'fail' are styled green and red.
+func (fsm *Fsm) WriteMermaid(w io.Writer, opts *DiagramOptions) error {
+
+	if opts == nil {
+		opts = &DiagramOptions{}
+	}
+	states, edges := fsm.diagram()
+
+	bw := bufio.NewWriter(w)
+
+	if opts.Title != "" {
+		fmt.Fprintf(bw, "---\ntitle: %s\n---\n",
+			mermaidText(opts.Title))
+	}
+	fmt.Fprintln(bw, "stateDiagram-v2")
+	fmt.Fprintln(bw, "  classDef init font-weight:bold,stroke-width:3px")
+	fmt.Fprintln(bw, "  classDef hit fill:#9e9,stroke:#393")
+	fmt.Fprintln(bw, "  classDef fail fill:#f9b,stroke:#c36")
+
+	for _, name := range states {
+		label := strings.Join(fsm.stateLabel(name, opts), "<br/>")
+		fmt.Fprintf(bw, "  state \"%s\" as %s\n", mermaidText(label),
+			mermaidId(name))
+	}
+
+	fmt.Fprintln(bw, "  [*] --> init")
+	for _, e := range edges {
+		fmt.Fprintf(bw, "  %s --> %s : %s\n", mermaidId(e.from),
+			mermaidId(e.to),
+			mermaidText(strings.Join(e.tokens, "<br/>")))
+	}
+
+	for _, name := range states {
+		if name == "init" || name == "hit" || name == "fail" {
+			fmt.Fprintf(bw, "  class %s %s\n", name, name)
+		}
+	}
+
+	return bw.Flush()
+
+}
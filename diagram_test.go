@@ -0,0 +1,47 @@
+package indicators
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// A state which others were merged into is only described by its own
+// terms, so diagrams note the merged states.
+func TestDiagramMergedStates(t *testing.T) {
+
+	term := func(v string) *Term { return &Term{Type: "t", Value: v} }
+
+	// After a or c, the FSM waits for b either way.
+	ind := &Indicator{Id: "merged", Term: Term{Or: []*Term{
+		{Sequence: []*Term{term("a"), term("b")}},
+		{Sequence: []*Term{term("c"), term("b")}},
+	}}}
+	fsm := ind.GenerateFsm()
+
+	if len(fsm.Merged["s1"]) != 2 {
+		t.Fatalf("expected 2 states merged into s1, got %v",
+			fsm.Merged)
+	}
+
+	opts := &DiagramOptions{Navigator: ind.BuildNavigator()}
+	var dot, mermaid bytes.Buffer
+	if err := fsm.WriteDot(&dot, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsm.WriteMermaid(&mermaid, opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, out := range []string{dot.String(), mermaid.String()} {
+		if !strings.Contains(out, "(+2 merged states)") {
+			t.Errorf("merged states not noted:\n%s", out)
+		}
+	}
+
+	// Minimising again keeps the record.
+	fsm.Minimise()
+	if len(fsm.Merged["s1"]) != 2 {
+		t.Errorf("merged states lost: %v", fsm.Merged)
+	}
+
+}
@@ -0,0 +1,230 @@
+package indicators
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// Match term flavour for domain-like tokens.
+const (
+	// Token value must be the domain in the term value, or a subdomain
+	// of it e.g. malware.org matches malware.org and cdn.malware.org,
+	// but not evilmalware.org.
+	MatchSuffix = "suffix"
+)
+
+// Returns true if a token type holds domain names.
+func isDomainType(typ string) bool {
+	switch typ {
+	case "hostname", "domain", "fqdn":
+		return true
+	}
+	return false
+}
+
+// Longest domain name and label allowed by DNS.
+const (
+	maxDomainLength = 253
+	maxLabelLength  = 63
+)
+
+// Converts a domain name to canonical form: lower case, with no trailing
+// dot, and with internationalised labels converted to their ASCII
+// punycode form e.g. "Bücher.Example." -> "xn--bcher-kva.example".
+// Unicode normalisation beyond lower-casing is not done.
+func canonicalDomain(name string) (string, error) {
+
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".")
+	if name == "" {
+		return "", errors.New("empty domain name")
+	}
+
+	// Punycode encoding is quadratic in label length, so don't attempt
+	// names which can't be valid anyway.  Non-ASCII characters take up
+	// to 4 bytes.
+	if len(name) > 4*maxDomainLength {
+		return "", errors.New("domain name too long")
+	}
+
+	labels := strings.Split(strings.ToLower(name), ".")
+	for i, label := range labels {
+		if label == "" {
+			return "", errors.New("empty label in domain name")
+		}
+		if !isASCII(label) {
+			encoded, err := punycodeEncode(label)
+			if err != nil {
+				return "", err
+			}
+			labels[i] = "xn--" + encoded
+		}
+		if len(labels[i]) > maxLabelLength {
+			return "", errors.New("label too long in domain name")
+		}
+	}
+
+	return strings.Join(labels, "."), nil
+
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Punycode parameters from RFC 3492.
+const (
+	punyBase        = 36
+	punyTmin        = 1
+	punyTmax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((punyBase-punyTmin)*punyTmax)/2 {
+		delta /= punyBase - punyTmin
+		k += punyBase
+	}
+	return k + (punyBase-punyTmin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// Encodes a label using punycode, RFC 3492 section 6.3.
+func punycodeEncode(label string) (string, error) {
+
+	runes := []rune(label)
+	out := []byte{}
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for handled < len(runes) {
+
+		// Find the smallest code point not yet handled.
+		m := int(utf8.MaxRune) + 1
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		if (m-n)*(handled+1) > 1<<30 {
+			return "", errors.New("domain label too long to encode")
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTmin {
+					t = punyTmin
+				} else if t > punyTmax {
+					t = punyTmax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+
+		delta++
+		n++
+
+	}
+
+	return string(out), nil
+
+}
+
+// A trie of domain names keyed on labels in reverse order, so that
+// malware.org is stored under "org" then "malware".  Looking up a name
+// walks one path from the root, collecting the symbols of all domains the
+// name is equal to or a subdomain of.
+type suffixTrie struct {
+	child   map[string]*suffixTrie
+	symbols []int32
+}
+
+// Adds a canonical domain name to the trie.
+func (t *suffixTrie) insert(domain string, sym int32) {
+	node := t
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.child == nil {
+			node.child = map[string]*suffixTrie{}
+		}
+		next, ok := node.child[labels[i]]
+		if !ok {
+			next = &suffixTrie{}
+			node.child[labels[i]] = next
+		}
+		node = next
+	}
+	for _, v := range node.symbols {
+		if v == sym {
+			return
+		}
+	}
+	node.symbols = append(node.symbols, sym)
+}
+
+// Appends the symbols for all domains which a canonical domain name is
+// equal to or a subdomain of to syms.
+func (t *suffixTrie) lookup(domain string, syms []int32) []int32 {
+	node := t
+	for end := len(domain); node != nil; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		node = node.child[domain[start:end]]
+		if node == nil {
+			break
+		}
+		syms = append(syms, node.symbols...)
+		if start == 0 {
+			break
+		}
+		end = start - 1
+	}
+	return syms
+}
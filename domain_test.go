@@ -0,0 +1,125 @@
+package indicators
+
+import (
+	"testing"
+)
+
+// Sample strings from RFC 3492 section 7.1.
+func TestPunycodeEncode(t *testing.T) {
+
+	for _, c := range []struct {
+		name, label, expect string
+	}{
+		{"arabic", "ليهمابتك" +
+			"لموشعربي؟",
+			"egbpdaj6bu4bxfgehfvwxn"},
+		{"chinese simplified", "他们为什么不" +
+			"说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+		{"chinese traditional", "他們爲什麽" +
+			"不說中文",
+			"ihqwctvzc91f659drss3x8bo0yb"},
+		{"czech", "Pročprostěnemluvíčesky",
+			"Proprostnemluvesky-uyb24dma41a"},
+		{"hebrew", "למההםפשוט" +
+			"לאמדבריםעברית",
+			"4dbcagdahymbxekheh6e0a7fei0b"},
+		{"russian", "почемуже" +
+			"онинегов" +
+			"орятпору" +
+			"сски",
+			"b1abfaaepdrnnbgefbadotcwatmq2g4l"},
+		{"spanish", "PorquénopuedensimplementehablarenEspañol",
+			"PorqunopuedensimplementehablarenEspaol-fmd56a"},
+		{"vietnamese", "Tạisaohọkhôngthểchỉ" +
+			"nóitiếngViệt",
+			"TisaohkhngthchnitingVit-kjcr8268qyxafd2f1b9g"},
+		{"japanese mixed", "3年B組金八先生",
+			"3B-ww4c5e180e575a65lsy2b"},
+		{"japanese hyphens", "安室奈美恵-with-" +
+			"SUPER-MONKEYS",
+			"-with-SUPER-MONKEYS-pc58ag80a8qai00g7n9n"},
+		{"japanese trailing", "Hello-Another-Way-それぞ" +
+			"れの場所",
+			"Hello-Another-Way--fc4qua05auwb3674vfr0b"},
+		{"japanese digit", "ひとつ屋根の" +
+			"下2", "2-u9tlzr9756bt3uc0v"},
+		{"japanese latin", "MajiでKoiする5秒前",
+			"MajiKoi5-783gue6qz075azm5e"},
+		{"japanese de", "パフィーdeルンバ",
+			"de-jg4avhby1noc0d"},
+		{"japanese kana", "そのスピードで",
+			"d9juau41awczczp"},
+		{"ascii", "-> $1.00 <-", "-> $1.00 <--"},
+	} {
+		got, err := punycodeEncode(c.label)
+		if err != nil || got != c.expect {
+			t.Errorf("%s: expected %s, got %s %v", c.name, c.expect,
+				got, err)
+		}
+	}
+
+}
+
+func TestCanonicalDomain(t *testing.T) {
+
+	for _, c := range []struct {
+		name, expect string
+	}{
+		{"Bücher.Example.", "xn--bcher-kva.example"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example"},
+		{" WWW.Example.ORG ", "www.example.org"},
+		{"", ""},
+		{"a..b", ""},
+	} {
+		got, err := canonicalDomain(c.name)
+		if c.expect == "" {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %s",
+					c.name, got)
+			}
+			continue
+		}
+		if err != nil || got != c.expect {
+			t.Errorf("%q: expected %s, got %s %v", c.name,
+				c.expect, got, err)
+		}
+	}
+
+}
+
+// Suffix terms and tokens match whether written in Unicode or punycode.
+func TestSuffixIDN(t *testing.T) {
+
+	ii, err := LoadIndicators([]byte(`{"indicators": [
+		{"id": "unicode", "type": "hostname", "match": "suffix",
+			"value": "Bücher.Example"},
+		{"id": "punycode", "type": "hostname", "match": "suffix",
+			"value": "xn--bcher-kva.example"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := CreateRuleset(ii, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		hostname string
+		hits     int
+	}{
+		{"shop.bücher.example", 2},
+		{"shop.xn--bcher-kva.example", 2},
+		{"BÜCHER.example.", 2},
+		{"bucher.example", 0},
+	} {
+		s := rs.NewScanner()
+		s.Update(Token{Type: "hostname", Value: c.hostname})
+		if hits := len(s.GetHits()); hits != c.hits {
+			t.Errorf("%s: expected %d hits, got %d", c.hostname,
+				c.hits, hits)
+		}
+	}
+
+}
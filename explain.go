@@ -0,0 +1,247 @@
+package indicators
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A transition taken by an FSM, recorded by a Scanner in explain mode.
+type pathStep struct {
+	state, sym, next int32
+	token            Token
+	sequence         uint64
+}
+
+// One step on the path an FSM took from 'init' to 'hit'.
+type ExplainStep struct {
+
+	// The FSM event: the state the FSM was in, and the FSM token of
+	// the match term which caused the transition.
+	Event FsmEvent
+
+	// The state the event led to.
+	Next string
+
+	// The token passed to Update, and its sequence number.
+	Observed Token
+	Sequence uint64
+
+	// State names, as in Navigator.StateName, of the match terms the
+	// token satisfied.
+	Terms []string
+}
+
+// Explains why an indicator hit.
+type Explanation struct {
+
+	// The indicator which hit.
+	Indicator *Indicator
+
+	// Path from 'init' to 'hit'.
+	Steps []ExplainStep
+
+	// Maps state name of each term which was true when the indicator
+	// hit to the sequence number of the token which made it true.
+	// Terms are those of Navigator.
+	Satisfied map[string]uint64
+
+	// State names of NOT terms which were true because the negated term
+	// was absent at 'end'.
+	Absent []string
+
+	// Navigator for the indicator's term tree as written, rather than
+	// the simplified tree which was compiled.
+	Navigator *Navigator
+}
+
+// Records an FSM transition, if in explain mode.
+func (s *Scanner) record(fsm, state, sym, next int32) {
+	if !s.Explain {
+		return
+	}
+	s.paths[fsm] = append(s.paths[fsm], pathStep{
+		state:    state,
+		sym:      sym,
+		next:     next,
+		token:    s.token,
+		sequence: s.Sequence,
+	})
+}
+
+// Returns explanations for all hits, in the order the indicators were
+// loaded, as for GetHits.  Paths are only recorded when the Scanner's
+// Explain flag is set, so it must be set before scanning.
+func (s *Scanner) ExplainHits() []*Explanation {
+
+	explanations := []*Explanation{}
+
+	for _, fsm := range s.hitFsms() {
+		explanations = append(explanations, s.explain(fsm))
+	}
+
+	return explanations
+
+}
+
+// Builds the explanation for one FSM.
+func (s *Scanner) explain(fsm int32) *Explanation {
+
+	ind := s.Ruleset.Indicators[fsm]
+	table := s.Ruleset.Fsms[fsm]
+	n := ind.Term.navigator()
+
+	e := &Explanation{
+		Indicator: ind,
+		Satisfied: map[string]uint64{},
+		Navigator: n,
+	}
+
+	// Replay the path through the term tree, to find out which terms
+	// each step satisfied.
+	state := NewCombination()
+
+	for _, step := range s.paths[fsm] {
+
+		token := s.Ruleset.Symbols.Tokens[step.sym]
+		before := state.Copy()
+
+		es := ExplainStep{
+			Event: FsmEvent{
+				State: table.States[step.state],
+				Token: token,
+			},
+			Next:     table.States[step.next],
+			Observed: step.token,
+			Sequence: step.sequence,
+		}
+
+		if token == EndToken {
+			ind.Term.RecordEnd(&state, n)
+		} else {
+			// A compound token applies all its components
+			// together.
+			parts := []Token{token}
+			if token.Match == matchCompound {
+				parts, _ = token.components()
+			}
+			matched := []*Term{}
+			for _, term := range n.Terms {
+				for _, part := range parts {
+					if term.Token() != part {
+						continue
+					}
+					es.Terms = append(es.Terms,
+						n.StateName[term])
+					matched = append(matched, term)
+				}
+			}
+			activateAll(matched, &state, &before, n)
+		}
+
+		// Note when each term became true.
+		for t := range state.Iter() {
+			if !before.Contains(t) {
+				e.Satisfied[n.StateName[t]] = step.sequence
+				if t.IsNot() {
+					e.Absent = append(e.Absent,
+						n.StateName[t])
+				}
+			}
+		}
+
+		// Terms which were forgotten e.g. out-of-order sequence
+		// steps no longer explain anything.
+		for t := range before.Iter() {
+			if !state.Contains(t) {
+				delete(e.Satisfied, n.StateName[t])
+			}
+		}
+
+		e.Steps = append(e.Steps, es)
+
+	}
+
+	sort.Strings(e.Absent)
+
+	return e
+
+}
+
+// Returns a human-readable explanation: the path from 'init' to 'hit',
+// and the term tree annotated with what satisfied each term.
+func (e *Explanation) Format() string {
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Indicator %s: %s\n", e.Indicator.Id,
+		e.Indicator.Descriptor.Description)
+
+	fmt.Fprintln(&b, "Path:")
+	for _, step := range e.Steps {
+		fmt.Fprintf(&b, "  #%d %s -> %s -> %s", step.Sequence,
+			step.Event.State, step.Event.Token, step.Next)
+		if step.Observed != step.Event.Token {
+			fmt.Fprintf(&b, " (observed %s)", step.Observed)
+		}
+		if len(step.Terms) > 0 {
+			fmt.Fprintf(&b, " satisfies %s",
+				strings.Join(step.Terms, ", "))
+		}
+		fmt.Fprintln(&b)
+	}
+
+	fmt.Fprintln(&b, "Terms:")
+	e.formatTree(&b, &e.Indicator.Term, 1)
+
+	return b.String()
+
+}
+
+// Dumps an explanation.
+func (e *Explanation) Dump() {
+	fmt.Print(e.Format())
+}
+
+// Formats a term tree in the style of DumpTree, annotating true terms.
+func (e *Explanation) formatTree(b *strings.Builder, l *Term, indent int) {
+
+	name := e.Navigator.StateName[l]
+	b.WriteString(strings.Repeat("  ", indent))
+	fmt.Fprint(b, name, ": ")
+
+	switch {
+	case l.IsAnd():
+		fmt.Fprint(b, "AND")
+	case l.IsOr():
+		fmt.Fprint(b, "OR")
+	case l.IsNot():
+		fmt.Fprint(b, "NOT")
+	case l.IsThreshold():
+		fmt.Fprint(b, "AT LEAST ", l.AtLeast, " OF")
+	case l.IsSequence():
+		fmt.Fprint(b, "SEQUENCE")
+	case l.IsMatchTerm():
+		fmt.Fprint(b, l.Token())
+	}
+
+	if seq, ok := e.Satisfied[name]; ok {
+		if l.IsNot() {
+			fmt.Fprintf(b, "  [true: negated term absent at "+
+				"end, #%d]", seq)
+		} else {
+			fmt.Fprintf(b, "  [true at #%d]", seq)
+		}
+	}
+	fmt.Fprintln(b)
+
+	children := append(append(append(append([]*Term{}, l.And...),
+		l.Or...), l.Of...), l.Sequence...)
+	if l.Not != nil {
+		children = append(children, l.Not)
+	}
+	for _, v := range children {
+		e.formatTree(b, v, indent+1)
+	}
+
+}
@@ -1,16 +1,93 @@
 package indicators
 
 import (
+	"encoding/json"
 	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 // FIXME: Strategy thing is missing.
 
-// Represents a type/value pair.
+// Represents a type/value pair.  Tokens passed to Update have only Type
+// and Value set.  Within an FSM, tokens identify the match terms which
+// cause transitions, and Match and Count are set for terms which aren't
+// plain exact matches, so that e.g. a regex term is never confused with an
+// exact term whose value happens to be the same string.
 type Token struct {
 	Type  string
 	Value string
+	Match string
+	Count int
+}
+
+// Orders tokens by type, match flavour, value and count.  Compound tokens
+// list their components in this order.
+func tokenLess(a, b Token) bool {
+	if a.Type != b.Type {
+		return a.Type < b.Type
+	}
+	if a.Match != b.Match {
+		return a.Match < b.Match
+	}
+	if a.Value != b.Value {
+		return a.Value < b.Value
+	}
+	return a.Count < b.Count
+}
+
+// Match flavour of compound tokens.  A compound token stands for several
+// match terms which are satisfied by the same token, and its value lists
+// their tokens.
+const matchCompound = "all"
+
+// Returns the compound token for the tokens of several match terms.
+func compoundToken(tokens []Token) Token {
+	parts := append([]Token{}, tokens...)
+	sort.Slice(parts, func(a, b int) bool {
+		return tokenLess(parts[a], parts[b])
+	})
+	value, _ := json.Marshal(parts)
+	return Token{Type: parts[0].Type, Match: matchCompound,
+		Value: string(value)}
+}
+
+// Returns the tokens a compound token stands for, in tokenLess order.
+func (t Token) components() ([]Token, error) {
+	var parts []Token
+	if err := json.Unmarshal([]byte(t.Value), &parts); err != nil {
+		return nil, err
+	}
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("compound token has %d components",
+			len(parts))
+	}
+	return parts, nil
+}
+
+// The token which marks the end of scanning.
+var EndToken = Token{Type: "end"}
+
+// Returns a human-readable form of the token.
+func (t Token) String() string {
+	if t.Match == matchCompound {
+		if parts, err := t.components(); err == nil {
+			names := make([]string, len(parts))
+			for i, part := range parts {
+				names[i] = part.String()
+			}
+			return "{" + strings.Join(names, " & ") + "}"
+		}
+	}
+	s := t.Type + ":" + t.Value
+	if t.Match != "" {
+		s = t.Type + ":" + t.Match + ":" + t.Value
+	}
+	if t.Count > 1 {
+		s += " x" + strconv.Itoa(t.Count)
+	}
+	return s
 }
 
 // Represents an FSM transition.
@@ -31,13 +108,24 @@ type FsmTransition struct {
 // FsmMap which is a structure optimised for navigation.
 type Fsm struct {
 	Transitions []FsmTransition
+
+	// Tokens of all the indicator's match terms, whether or not they
+	// cause transitions.
+	Terms []Token
+
+	// Sizes before and after minimisation, set by GenerateFsm and
+	// CompileFsm.
+	Minimised MinimiseStats
+
+	// Names of the states which minimisation merged into each state,
+	// other than its own.
+	Merged map[string][]string
 }
 
 func (fsm *Fsm) Dump() {
 	for _, v := range fsm.Transitions {
 		for _, w := range v.Token {
-			fmt.Printf("%s -> %s:%s -> %s\n",
-				v.Current, w.Type, w.Value, v.Next)
+			fmt.Printf("%s -> %s -> %s\n", v.Current, w, v.Next)
 		}
 	}
 }
@@ -54,8 +142,7 @@ type FsmMap map[FsmEvent]string
 
 func (fsm *FsmMap) Dump() {
 	for event, next := range *fsm {
-		fmt.Printf("%s -> %s:%s -> %s\n",
-			event.State, event.Token.Type, event.Token.Value, next)
+		fmt.Printf("%s -> %s -> %s\n", event.State, event.Token, next)
 	}
 }
 
@@ -138,6 +225,12 @@ func (fsm *Fsm) Flatten() {
 // - those which cannot lead to 'hit' are re-labeled as 'fail'.
 // - those which cannot be discovered from 'init' are removed altogether.
 func (fsm *Fsm) RemoveInvalidTransitions(n *Navigator) {
+	fsm.removeInvalidTransitions(func() bool { return false })
+}
+
+// As RemoveInvalidTransitions, but gives up, returning false and leaving
+// the FSM unchanged, if expired reports that the time budget has run out.
+func (fsm *Fsm) removeInvalidTransitions(expired func() bool) bool {
 
 	valid_hit_states := make(map[string]bool)
 	valid_hit_states["hit"] = true
@@ -153,6 +246,9 @@ func (fsm *Fsm) RemoveInvalidTransitions(n *Navigator) {
 		if len(valid_hit_states) == last_run_size {
 			break
 		}
+		if expired() {
+			return false
+		}
 		last_run_size = len(valid_hit_states)
 	}
 
@@ -170,6 +266,9 @@ func (fsm *Fsm) RemoveInvalidTransitions(n *Navigator) {
 		if len(valid_trav_states) == last_run_size {
 			break
 		}
+		if expired() {
+			return false
+		}
 		last_run_size = len(valid_trav_states)
 	}
 
@@ -184,6 +283,7 @@ func (fsm *Fsm) RemoveInvalidTransitions(n *Navigator) {
 		transitions = append(transitions, v)
 	}
 	fsm.Transitions = transitions
+	return true
 
 }
 
@@ -270,16 +370,31 @@ func GetCombinations(l chan *Term) Combinations {
 // is term is observed.
 func (i *Indicator) ExerciseToken(current Combination, term *Term, n *Navigator) Combination {
 
+	// term=nil tests the 'end' state.
+	if term == nil {
+		return i.ExerciseTerms(current, nil, n)
+	}
+
+	return i.ExerciseTerms(current, []*Term{term}, n)
+
+}
+
+// Return new state which describes what happens when a token satisfying
+// all of the given terms is observed.  The terms are all activated by the
+// one token, so advance a sequence by at most one step between them, and
+// the result doesn't depend on their order.  terms=nil tests the 'end'
+// state.
+func (i *Indicator) ExerciseTerms(current Combination, terms []*Term, n *Navigator) Combination {
+
 	// Start with a copy of the 'current' state.
 	next := current.Copy()
 
-	// term=nil tests the 'end' state.
-	if term == nil {
+	if terms == nil {
 		// See what happens when 'end' is observed.
-		i.RecordEnd(&next, n)
+		i.root().RecordEnd(&next, n)
 	} else {
-		// See what happens when this term is observed.
-		term.Activate(&next, n)
+		// See what happens when these terms are observed.
+		activateAll(terms, &next, &current, n)
 	}
 
 	// Return the new state.
@@ -287,6 +402,139 @@ func (i *Indicator) ExerciseToken(current Combination, term *Term, n *Navigator)
 
 }
 
+// Returns the token of each group of match terms, see GroupTerms.
+func groupTokens(groups [][]*Term) []Token {
+	tokens := make([]Token, 0, len(groups))
+	for _, group := range groups {
+		tokens = append(tokens, group[0].Token())
+	}
+	return tokens
+}
+
+// Groups match terms by the FSM token which identifies them.  A tree can
+// contain the same match term more than once e.g. A AND NOT A, and a token
+// must activate all of them together, rather than the FSM having a
+// transition for each.  Groups are in order of first appearance, and
+// terms keep their order within a group.
+func GroupTerms(terms []*Term) [][]*Term {
+	index := map[Token]int{}
+	groups := [][]*Term{}
+	for _, term := range terms {
+		token := term.Token()
+		g, ok := index[token]
+		if !ok {
+			g = len(groups)
+			index[token] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], term)
+	}
+	return groups
+}
+
+// Returns the FSM token for a group of match terms: the terms' token if
+// they all share one, or otherwise the compound token for all of theirs.
+func groupToken(group []*Term) Token {
+	tokens := []Token{}
+	seen := map[Token]bool{}
+	for _, term := range group {
+		if token := term.Token(); !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == 1 {
+		return tokens[0]
+	}
+	return compoundToken(tokens)
+}
+
+// Returns true if a single token might satisfy both of two match terms.
+// Terms of the same type are assumed to overlap unless both are exact
+// matches, or one is an exact match which the other doesn't match.
+func overlaps(a, b *Term) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	exactA := a.Match == "" || a.Match == MatchExact
+	exactB := b.Match == "" || b.Match == MatchExact
+	switch {
+	case exactA && exactB:
+		return a.Value == b.Value
+	case exactA:
+		return b.Matches(Token{Type: a.Type, Value: a.Value})
+	case exactB:
+		return a.Matches(Token{Type: b.Type, Value: b.Value})
+	}
+	return true
+}
+
+// Returns the combinations of two or more groups of match terms, see
+// GroupTerms, which a single token might satisfy together, each as one
+// group of all their terms.  The FSM needs a transition for each, as the
+// terms a token satisfies are applied together rather than one after
+// another.
+func CompoundGroups(groups [][]*Term) [][]*Term {
+
+	compounds := [][]*Term{}
+
+	// Extends a set of pairwise overlapping groups with each later
+	// group which overlaps all of them.
+	var extend func(set []int, terms []*Term)
+	extend = func(set []int, terms []*Term) {
+		if len(set) > 1 {
+			compounds = append(compounds, terms)
+		}
+	next:
+		for g := set[len(set)-1] + 1; g < len(groups); g++ {
+			for _, other := range set {
+				if !overlaps(groups[g][0], groups[other][0]) {
+					continue next
+				}
+			}
+			extend(append(append([]int{}, set...), g),
+				append(append([]*Term{}, terms...),
+					groups[g]...))
+		}
+	}
+
+	for g := range groups {
+		extend([]int{g}, groups[g])
+	}
+
+	return compounds
+
+}
+
+// Reduces a state combination resulting from exercising a token to the
+// basic states, and returns the reduced combination along with its state
+// name.  If the root of the term tree is active, the state is 'hit'.
+func (i *Indicator) ReduceState(state Combination, n *Navigator) (Combination, string) {
+
+	root := i.root()
+
+	if state.Contains(root) {
+		return state, "hit"
+	}
+
+	// The new state combination is reduced by taking out all states
+	// which aren't basic states.  States below a threshold which is
+	// already true are also taken out, as they can no longer affect
+	// anything.  This means a threshold's states only record which
+	// children are true until the threshold is reached.  Until then,
+	// states can't be merged by counting true children, as the FSM
+	// must know which children a repeated token has already satisfied.
+	reduced := NewCombination()
+	for v := range state.Iter() {
+		if n.BasicStates.Contains(v) && !n.BelowThreshold(v, &state) {
+			reduced.Add(v)
+		}
+	}
+
+	return reduced, NameCombinationState(&reduced, n, root)
+
+}
+
 // Extract all FSM transition by exercising all possible terms in all
 // possible basic state combinations.
 func (i *Indicator) ExtractTransitions(basic_combis Combinations, terms []*Term, n *Navigator) *Fsm {
@@ -295,7 +543,10 @@ func (i *Indicator) ExtractTransitions(basic_combis Combinations, terms []*Term,
 	transitions := []FsmTransition{}
 
 	// Get root of term tree
-	root := &i.Term
+	root := i.root()
+
+	groups := GroupTerms(terms)
+	exercise := append(groups, CompoundGroups(groups)...)
 
 	// Iterate over all state combinations
 	for _, comb := range basic_combis {
@@ -303,32 +554,16 @@ func (i *Indicator) ExtractTransitions(basic_combis Combinations, terms []*Term,
 		// Get state name for the combination state.
 		cur_state := NameCombinationState(&comb, n, root)
 
-		// Iterate over all terms
-		for _, term := range terms {
+		// Iterate over all terms, grouped by token, and the
+		// combinations of groups one token can satisfy.
+		for _, group := range exercise {
 
 			// Get the state which results from observing this
 			// token in the current state
-			newstate := i.ExerciseToken(comb, term, n)
-
-			// The new state combination is reduced by taking
-			// out all states which aren't basic states.
-			var next_state string
-
-			if newstate.Contains(&i.Term) {
-				next_state = "hit"
-			} else {
-
-				newstate2 := NewCombination()
-				for v := range newstate.Iter() {
-					if n.BasicStates.Contains(v) {
-						newstate2.Add(v)
-					}
-				}
+			newstate := i.ExerciseTerms(comb, group, n)
 
-				// Convert this new state to a state name.
-				next_state =
-					NameCombinationState(&newstate2, n, root)
-			}
+			// Convert this new state to a state name.
+			_, next_state := i.ReduceState(newstate, n)
 
 			// If the term causes no state transition, we can
 			// move on.
@@ -339,7 +574,7 @@ func (i *Indicator) ExtractTransitions(basic_combis Combinations, terms []*Term,
 			// Create transation and add to transition array
 			transition := FsmTransition{
 				Current: cur_state,
-				Token:   []Token{Token{term.Type, term.Value}},
+				Token:   []Token{groupToken(group)},
 				Next:    next_state,
 			}
 			transitions = append(transitions, transition)
@@ -356,23 +591,7 @@ func (i *Indicator) ExtractTransitions(basic_combis Combinations, terms []*Term,
 		newstate := i.ExerciseToken(comb, nil, n)
 
 		cur_state := NameCombinationState(&comb, n, root)
-		var next_state string
-
-		if newstate.Contains(&i.Term) {
-			next_state = "hit"
-		} else {
-
-			newstate2 := NewCombination()
-			for v := range newstate.Iter() {
-				if n.BasicStates.Contains(v) {
-					newstate2.Add(v)
-				}
-			}
-
-			// Convert this new state to a state name.
-			next_state =
-				NameCombinationState(&newstate2, n, root)
-		}
+		_, next_state := i.ReduceState(newstate, n)
 
 		if cur_state == next_state {
 			continue
@@ -380,7 +599,7 @@ func (i *Indicator) ExtractTransitions(basic_combis Combinations, terms []*Term,
 
 		transition := FsmTransition{
 			Current: cur_state,
-			Token:   []Token{Token{"end", ""}},
+			Token:   []Token{EndToken},
 			Next:    next_state,
 		}
 
@@ -391,22 +610,121 @@ func (i *Indicator) ExtractTransitions(basic_combis Combinations, terms []*Term,
 	// Create and return an FSM.
 	fsm := &Fsm{
 		Transitions: transitions,
+		Terms:       groupTokens(groups),
 	}
 	return fsm
 
 }
 
+// Extract FSM transitions by exploring only those basic state combinations
+// which can be reached from 'init'.  This is a breadth-first search: each
+// newly discovered state is exercised with all terms and 'end', and any
+// state it leads to which hasn't been seen is added to the work list.  The
+// transitions found are the same as those ExtractTransitions finds which
+// survive RemoveInvalidTransitions, but the cost is proportional to the
+// number of reachable states rather than every subset of basic states.
+// Exploration stops with a ComplexityError if the budget in opts is
+// exceeded.  opts may be nil, meaning no limits.
+func (i *Indicator) ExploreTransitions(terms []*Term, n *Navigator, opts *CompileOptions) (*Fsm, error) {
+	return i.exploreTransitions(terms, n, opts, timeBudget(opts))
+}
+
+// As ExploreTransitions, but with the time budget given by expired rather
+// than by opts.MaxTime, so that it can be shared with later stages.
+func (i *Indicator) exploreTransitions(terms []*Term, n *Navigator, opts *CompileOptions, expired func() bool) (*Fsm, error) {
+
+	if opts == nil {
+		opts = &CompileOptions{}
+	}
+
+	// Start with transitions as an empty array
+	transitions := []FsmTransition{}
+
+	// Exercise all terms grouped by token, the combinations of groups
+	// one token can satisfy, and nil, which tests the 'end' state.
+	groups := GroupTerms(terms)
+	exercise := append(append(groups, CompoundGroups(groups)...), nil)
+
+	// The work list starts with the 'init' state, the empty set.
+	queue := Combinations{NewCombination()}
+	seen := map[string]bool{"init": true}
+
+	for len(queue) > 0 {
+
+		if expired() {
+			return nil, i.timeError(opts)
+		}
+
+		comb := queue[0]
+		queue = queue[1:]
+
+		cur_state := NameCombinationState(&comb, n, i.root())
+
+		for _, group := range exercise {
+
+			newstate := i.ExerciseTerms(comb, group, n)
+			next, next_state := i.ReduceState(newstate, n)
+
+			// If the term causes no state transition, we can
+			// move on.
+			if cur_state == next_state {
+				continue
+			}
+
+			token := EndToken
+			if group != nil {
+				token = groupToken(group)
+			}
+
+			transitions = append(transitions, FsmTransition{
+				Current: cur_state,
+				Token:   []Token{token},
+				Next:    next_state,
+			})
+
+			if opts.MaxTransitions > 0 &&
+				len(transitions) > opts.MaxTransitions {
+				return nil, i.complexityError("transitions",
+					int64(opts.MaxTransitions))
+			}
+
+			// The 'hit' state has no transitions out of it, so
+			// there's no need to explore it.
+			if next_state == "hit" || seen[next_state] {
+				continue
+			}
+			seen[next_state] = true
+			queue = append(queue, next)
+
+			if opts.MaxStates > 0 && len(seen) > opts.MaxStates {
+				return nil, i.complexityError("states",
+					int64(opts.MaxStates))
+			}
+
+		}
+
+	}
+
+	return &Fsm{Transitions: transitions, Terms: groupTokens(groups)},
+		nil
+
+}
+
 // Find all 'basic states' and terms.  The basic states are the places in
 // the tree where state information can stored: Children of AND and children
 // of NOT.  NOT nodes are never themselves basic state nodes.
 func (i *Indicator) DiscoverStates(n *Navigator) (Combination, []*Term) {
+	return i.root().discoverStates(n)
+}
+
+func (l *Term) discoverStates(n *Navigator) (Combination, []*Term) {
 
 	// Initialise
 	basic_states := NewCombination()
 	terms := []*Term{}
 
 	// Walk the term tree
-	i.Walk(func(l *Term, state interface{}, par *Term) error {
+	l.Walk(func(l *Term, state interface{}, par *Term) error {
 
 		// Collect match terms
 		if l.IsMatchTerm() {
@@ -423,11 +741,17 @@ func (i *Indicator) DiscoverStates(n *Navigator) (Combination, []*Term) {
 			return nil
 		}
 
-		// If we got this far, and parent is AND or NOT, this is a
-		// basic state.
+		// If we got this far, and parent is AND, NOT, threshold or
+		// sequence, this is a basic state.
 		if n.Parent[l].IsAnd() {
 			basic_states.Add(l)
 		}
+		if n.Parent[l].IsThreshold() {
+			basic_states.Add(l)
+		}
+		if n.Parent[l].IsSequence() {
+			basic_states.Add(l)
+		}
 		if n.Parent[l].IsNot() {
 			basic_states.Add(l)
 		}
@@ -462,8 +786,20 @@ func (l *Term) DumpTree(n *Navigator, indent int) {
 		fmt.Println("NOT")
 		l.Not.DumpTree(n, indent+1)
 	}
+	if l.IsThreshold() {
+		fmt.Println("AT LEAST", l.AtLeast, "OF")
+		for _, v := range l.Of {
+			v.DumpTree(n, indent+1)
+		}
+	}
+	if l.IsSequence() {
+		fmt.Println("SEQUENCE")
+		for _, v := range l.Sequence {
+			v.DumpTree(n, indent+1)
+		}
+	}
 	if l.IsMatchTerm() {
-		fmt.Println(l.Type, ":", l.Value)
+		fmt.Println(l.Token())
 	}
 
 }
@@ -485,6 +821,67 @@ func (i *Indicator) GenerateFsm() *Fsm {
 	// Remove invalid transition
 	fsm.RemoveInvalidTransitions(n)
 
+	// Merge equivalent states.
+	fsm.Minimised = fsm.Minimise()
+
+	return fsm
+
+}
+
+// Generate an FSM from an indicator, only exploring states which are
+// reachable from 'init'.  Produces the same FSM as GenerateFsm, but does
+// not enumerate all combinations of basic states first, so is suitable
+// for indicators with many AND/NOT children.
+func (i *Indicator) GenerateFsmLazy() *Fsm {
+
+	// Without limits, compilation can't fail.
+	fsm, _ := i.CompileFsm(nil)
 	return fsm
 
 }
+
+// Generate an FSM from an indicator in the same way as GenerateFsmLazy,
+// but giving up with a ComplexityError if the indicator exceeds the
+// compilation budget in opts.  opts may be nil, meaning no limits.  The
+// time limit covers every stage, not just exploring states.
+func (i *Indicator) CompileFsm(opts *CompileOptions) (*Fsm, error) {
+
+	expired := timeBudget(opts)
+
+	n := i.BuildNavigator()
+
+	// Get transitions for reachable states.
+	fsm, err := i.exploreTransitions(n.Terms, n, opts, expired)
+	if err != nil {
+		return nil, err
+	}
+
+	// Flatten FSM
+	fsm.Flatten()
+	if expired() {
+		return nil, i.timeError(opts)
+	}
+
+	// Relabel transitions which can't lead to 'hit' as 'fail'.
+	if !fsm.removeInvalidTransitions(expired) {
+		return nil, i.timeError(opts)
+	}
+
+	// Merge equivalent states.
+	stats, ok := fsm.minimise(expired)
+	if !ok {
+		return nil, i.timeError(opts)
+	}
+	fsm.Minimised = stats
+
+	if opts != nil && opts.MaxTableSize > 0 &&
+		fsm.TableSize() > opts.MaxTableSize {
+		return nil, i.complexityError("table", int64(opts.MaxTableSize))
+	}
+	if expired() {
+		return nil, i.timeError(opts)
+	}
+
+	return fsm, nil
+
+}
@@ -0,0 +1,44 @@
+package indicators
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// Largest number of basic states for which eager FSM generation is
+// compared.
+const maxEager = 8
+
+// Returns an FSM's transitions in a canonical order.
+func transitions(fsm *Fsm) []string {
+	out := []string{}
+	for event, next := range *fsm.Mapify() {
+		out = append(out, fmt.Sprintf("%s -> %s -> %s", event.State,
+			event.Token, next))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Checks that lazy and eager FSM generation agree.
+func checkLazy(tc testCase) string {
+
+	ind := prepared(tc.term)
+	if ind == nil || ind.BuildNavigator().BasicStates.Size() > maxEager {
+		return ""
+	}
+
+	lazy := transitions(ind.GenerateFsmLazy())
+	eager := transitions(ind.GenerateFsm())
+	if fmt.Sprint(lazy) != fmt.Sprint(eager) {
+		return fmt.Sprintf("lazy FSM %v differs from eager FSM %v",
+			lazy, eager)
+	}
+	return ""
+
+}
+
+func TestLazyMatchesEager(t *testing.T) {
+	generated(t, checkLazy)
+}
@@ -0,0 +1,121 @@
+package indicators
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Compilation limits used by the fuzz targets, small enough that every
+// input compiles quickly.
+var fuzzOptions = CompileOptions{
+	MaxStates:      1 << 10,
+	MaxTransitions: 1 << 14,
+	MaxTableSize:   1 << 20,
+	MaxTime:        time.Second,
+	SkipComplex:    true,
+}
+
+// Seeds the fuzz corpus with the indicators in the indicator files, one
+// per seed.  Small seeds keep minimising a failing input quick; large
+// inputs can still take a while, so limit it, e.g.
+//
+//	go test -run XXX -fuzz FuzzUpdate -fuzzminimizetime 1s
+func addIndicatorFiles(f *testing.F, add func(source []byte)) {
+	for _, path := range []string{"indicators.json", "ind2.json",
+		"ind3.json"} {
+		source, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		var file struct {
+			Indicators []json.RawMessage `json:"indicators"`
+		}
+		if err := json.Unmarshal(source, &file); err != nil {
+			f.Fatal(err)
+		}
+		for _, ind := range file.Indicators {
+			add([]byte(`{"indicators": [` + string(ind) + `]}`))
+		}
+	}
+}
+
+func FuzzLoadIndicators(f *testing.F) {
+	addIndicatorFiles(f, func(source []byte) { f.Add(source) })
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ii, err := LoadIndicators(data)
+		if err != nil {
+			return
+		}
+		for _, ind := range ii.Indicators {
+			// Simplification must leave a valid tree.
+			simplified := &Indicator{Id: ind.Id, Term: *ind.root()}
+			if err := simplified.Check(); err != nil {
+				t.Fatal(err)
+			}
+			ind.BuildNavigator()
+		}
+	})
+}
+
+func FuzzGenerateFsm(f *testing.F) {
+	addIndicatorFiles(f, func(source []byte) { f.Add(source) })
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ii, err := LoadIndicators(data)
+		if err != nil {
+			return
+		}
+		for _, ind := range ii.Indicators {
+			fsm, err := ind.CompileFsm(&fuzzOptions)
+			if err != nil {
+				continue
+			}
+			fsm.Mapify()
+			if ind.BuildNavigator().BasicStates.Size() <= maxEager {
+				ind.GenerateFsm()
+			}
+		}
+	})
+}
+
+// Tokens are one per line, as type:value, and are a second apart.
+func FuzzUpdate(f *testing.F) {
+	tokens := "tcp:80\nurl:http://www.example.com/malware.dat\n" +
+		"ipv4:10.0.0.1\nhostname:example.com\nemail:bad@example.com"
+	addIndicatorFiles(f, func(source []byte) { f.Add(source, tokens) })
+	f.Fuzz(func(t *testing.T, data []byte, tokens string) {
+
+		ii, err := LoadIndicators(data)
+		if err != nil {
+			return
+		}
+		rs, err := CreateRuleset(ii, &fuzzOptions)
+		if err != nil {
+			return
+		}
+
+		s := rs.NewScanner()
+		s.Explain = true
+		s.OnHit = func(Hit) {}
+		now := time.Unix(0, 0)
+
+		for _, line := range strings.Split(tokens, "\n") {
+			kv := strings.SplitN(line, ":", 2)
+			token := Token{Type: kv[0]}
+			if len(kv) > 1 {
+				token.Value = kv[1]
+			}
+			now = now.Add(time.Second)
+			s.UpdateAt(token, now)
+		}
+		s.UpdateAt(EndToken, now)
+
+		s.GetHits()
+		for _, e := range s.ExplainHits() {
+			e.Format()
+		}
+
+	})
+}
@@ -1,3 +1,3 @@
 module github.com/cybermaggedon/indicators
 
-go 1.14
+go 1.18
@@ -0,0 +1,196 @@
+package indicators
+
+import (
+	"sort"
+	"strings"
+)
+
+// Describes an indicator hit at the moment it happens.
+type Hit struct {
+
+	// The indicator which hit.
+	Indicator *Indicator
+
+	// The token which caused the hit.
+	Token Token
+
+	// Sequence number of the token which caused the hit.  Tokens are
+	// numbered from 1 since the Scanner was created or last Reset.  For
+	// an indicator with a window, the hit can be caused by an earlier
+	// token, once older evidence which stopped it has expired.
+	Sequence uint64
+}
+
+// A HitHandler is called once for each indicator hit, from within Update,
+// once the token which caused it has been applied to all FSMs.
+type HitHandler func(Hit)
+
+// Sends hits to a channel as they happen.  The channel should be buffered,
+// or read by another goroutine, as Update blocks until each hit is sent.
+func (s *Scanner) NotifyHits(ch chan<- Hit) {
+	s.OnHit = func(h Hit) {
+		ch <- h
+	}
+}
+
+// Calls the hit handler for FSMs which hit on the current token, in the
+// order the indicators were loaded.
+func (s *Scanner) notify(token Token) {
+	if s.OnHit == nil {
+		s.hits = s.hits[:0]
+		s.forgetReplayed()
+		return
+	}
+	sort.Slice(s.hits, func(a, b int) bool {
+		return s.hits[a] < s.hits[b]
+	})
+	for _, fsm := range s.hits {
+		hit := Hit{
+			Indicator: s.Ruleset.Indicators[fsm],
+			Token:     token,
+			Sequence:  s.Sequence,
+		}
+		if e, ok := s.replayed[fsm]; ok {
+			hit.Token, hit.Sequence = e.token, e.sequence
+		}
+		s.OnHit(hit)
+	}
+	s.hits = s.hits[:0]
+	s.forgetReplayed()
+}
+
+// Forgets FSMs which hit when their evidence was replayed.
+func (s *Scanner) forgetReplayed() {
+	for fsm := range s.replayed {
+		delete(s.replayed, fsm)
+	}
+}
+
+// Orders in which GetHitsWith returns hits.
+type HitOrder int
+
+const (
+	// Hits are in the order the indicators were loaded.
+	LoadOrder HitOrder = iota
+
+	// Hits are in descending order of probability, then in order of
+	// ID, then in the order the indicators were loaded.
+	ProbabilityOrder
+)
+
+// Options for GetHitsWith.
+type HitOptions struct {
+
+	// The order of the hits.
+	Order HitOrder
+
+	// If set, indicators with the same ID are returned once, as a copy
+	// of the first with the descriptors of all of them merged, see
+	// Descriptor.Merge.
+	Dedupe bool
+}
+
+// Merges another descriptor into this one, e.g. for indicators sharing an
+// ID.  Description, category, author and source become the distinct
+// values of both, separated by "; ".  Type and value are kept, unless
+// empty.  Probability becomes the higher of the two.
+func (d *Descriptor) Merge(o Descriptor) {
+	join := func(a, b string) string {
+		if b == "" {
+			return a
+		}
+		if a == "" {
+			return b
+		}
+		for _, v := range strings.Split(a, "; ") {
+			if v == b {
+				return a
+			}
+		}
+		return a + "; " + b
+	}
+	d.Description = join(d.Description, o.Description)
+	d.Category = join(d.Category, o.Category)
+	d.Author = join(d.Author, o.Author)
+	d.Source = join(d.Source, o.Source)
+	if d.Type == "" {
+		d.Type = o.Type
+	}
+	if d.Value == "" {
+		d.Value = o.Value
+	}
+	if o.Probability > d.Probability {
+		d.Probability = o.Probability
+	}
+}
+
+// Returns the indicators which have hit, in the order and form given by
+// opts.  opts may be nil, meaning load order without de-duplication, as
+// for GetHits.
+func (s *Scanner) GetHitsWith(opts *HitOptions) []*Indicator {
+
+	if opts == nil {
+		opts = &HitOptions{}
+	}
+
+	fsms := s.hitFsms()
+	hits := make([]*Indicator, 0, len(fsms))
+	for _, fsm := range fsms {
+		hits = append(hits, s.Ruleset.Indicators[fsm])
+	}
+
+	if opts.Dedupe {
+		hits = dedupeHits(hits)
+	}
+
+	if opts.Order == ProbabilityOrder {
+		sort.SliceStable(hits, func(a, b int) bool {
+			pa := hits[a].Descriptor.Probability
+			pb := hits[b].Descriptor.Probability
+			if pa != pb {
+				return pa > pb
+			}
+			return hits[a].Id < hits[b].Id
+		})
+	}
+
+	return hits
+
+}
+
+// Returns the IDs of FSMs in 'hit', in the order the indicators were
+// loaded, which FSM IDs follow.
+func (s *Scanner) hitFsms() []int32 {
+	fsms := []int32{}
+	s.eachState(func(fsm, state int32) {
+		if state == StateHit {
+			fsms = append(fsms, fsm)
+		}
+	})
+	sort.Slice(fsms, func(a, b int) bool {
+		return fsms[a] < fsms[b]
+	})
+	return fsms
+}
+
+// Returns hits with one indicator per ID, in order of the first indicator
+// with each ID.  Indicators which share an ID are replaced by a copy of
+// the first with their descriptors merged.
+func dedupeHits(hits []*Indicator) []*Indicator {
+
+	first := map[string]int{}
+	out := []*Indicator{}
+	for _, ind := range hits {
+		i, ok := first[ind.Id]
+		if !ok {
+			first[ind.Id] = len(out)
+			out = append(out, ind)
+			continue
+		}
+		merged := *out[i]
+		merged.Descriptor.Merge(ind.Descriptor)
+		out[i] = &merged
+	}
+	return out
+
+}
@@ -0,0 +1,126 @@
+package indicators
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Returns indicators which all hit on one token, with IDs out of order and
+// some shared, and various probabilities.
+func hitIndicators(t *testing.T) *Indicators {
+	list := []string{}
+	for i := 0; i < 20; i++ {
+		list = append(list, fmt.Sprintf(`{"id": "i%d", "type": "t",
+			"value": "a", "descriptor": {"description": "d%d",
+			"probability": %g}}`, (20-i)%7, i, float64(i%4+1)/4))
+	}
+	ii, err := LoadIndicators([]byte(`{"indicators": [` +
+		strings.Join(list, ",") + `]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ii
+}
+
+// Hits and explanations are in load order, however the FSMs ran.
+func TestHitOrder(t *testing.T) {
+
+	ii := hitIndicators(t)
+
+	for _, product := range []bool{false, true} {
+
+		rs, err := CreateRuleset(ii, &CompileOptions{Product: product})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Map iteration order varies, so try several times.
+		for run := 0; run < 10; run++ {
+
+			s := rs.NewScanner()
+			s.Explain = true
+			notified := []*Indicator{}
+			s.OnHit = func(h Hit) {
+				notified = append(notified, h.Indicator)
+			}
+			s.Update(Token{Type: "t", Value: "a"})
+
+			hits := s.GetHits()
+			explanations := s.ExplainHits()
+			if len(hits) != len(ii.Indicators) ||
+				len(explanations) != len(hits) ||
+				len(notified) != len(hits) {
+				t.Fatalf("product=%v: %d hits, %d "+
+					"explanations, %d notified", product,
+					len(hits), len(explanations),
+					len(notified))
+			}
+			for i, ind := range ii.Indicators {
+				if hits[i] != ind ||
+					explanations[i].Indicator != ind ||
+					notified[i] != ind {
+					t.Fatalf("product=%v: hit %d out of "+
+						"order", product, i)
+				}
+			}
+
+		}
+
+	}
+
+}
+
+func TestHitsWith(t *testing.T) {
+
+	ii := hitIndicators(t)
+	rs, err := CreateRuleset(ii, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := rs.NewScanner()
+	s.Update(Token{Type: "t", Value: "a"})
+
+	// Descending probability, then ID, then load order.
+	hits := s.GetHitsWith(&HitOptions{Order: ProbabilityOrder})
+	for i := 1; i < len(hits); i++ {
+		a, b := hits[i-1], hits[i]
+		pa, pb := a.Descriptor.Probability, b.Descriptor.Probability
+		if pa < pb || pa == pb && a.Id > b.Id {
+			t.Errorf("hits %d and %d out of order: %s %g, %s %g",
+				i-1, i, a.Id, pa, b.Id, pb)
+		}
+	}
+
+	// One hit per ID, in order of first appearance, with descriptors
+	// merged.
+	hits = s.GetHitsWith(&HitOptions{Dedupe: true})
+	ids := []string{}
+	for _, ind := range hits {
+		ids = append(ids, ind.Id)
+	}
+	expect := "i6,i5,i4,i3,i2,i1,i0"
+	if strings.Join(ids, ",") != expect {
+		t.Errorf("expected %s, got %s", expect, strings.Join(ids, ","))
+	}
+	d := hits[0].Descriptor
+	if d.Description != "d0; d7; d14" || d.Probability != 1 {
+		t.Errorf("wrong merged descriptor %+v", d)
+	}
+	if ii.Indicators[0].Descriptor.Description != "d0" {
+		t.Error("dedupe changed the loaded indicator")
+	}
+
+}
+
+func TestDescriptorMerge(t *testing.T) {
+	d := Descriptor{Description: "a", Category: "x", Probability: 0.5}
+	d.Merge(Descriptor{Description: "b", Category: "x", Type: "t",
+		Probability: 0.25})
+	d.Merge(Descriptor{Description: "a", Author: "c"})
+	expect := Descriptor{Description: "a; b", Category: "x", Author: "c",
+		Type: "t", Probability: 0.5}
+	if d != expect {
+		t.Errorf("expected %+v, got %+v", expect, d)
+	}
+}
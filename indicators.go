@@ -44,6 +44,10 @@ type Indicator struct {
 	Id         string     `json:"id,omitempty"`
 	Descriptor Descriptor `json:"descriptor,omitempty"`
 	Term
+
+	// Simplified copy of Term, which is compiled instead of it.  Set by
+	// Simplify.
+	compiled *Term
 }
 
 // Loads indicators from a byte array
@@ -59,14 +63,49 @@ func LoadIndicators(data []byte) (*Indicators, error) {
 	// setting 0 and a missing field, but in practice specifying a
 	// probability of 0 doesn't make sense.
 	for i, _ := range ii.Indicators {
+		if ii.Indicators[i] == nil {
+			continue
+		}
 		if ii.Indicators[i].Descriptor.Probability == 0.0 {
 			ii.Indicators[i].Descriptor.Probability = 1.0
 		}
 	}
 
+	err = ii.Prepare()
+	if err != nil {
+		return nil, err
+	}
+
 	return &ii, nil
 }
 
+// Loads indicators from a byte array, dropping any indicators which fail
+// validation rather than failing altogether.  The problems with dropped
+// indicators are returned.  An error is only returned for input which
+// isn't valid JSON.
+func LoadIndicatorsLenient(data []byte) (*Indicators, []Problem, error) {
+	var ii Indicators
+	err := json.Unmarshal(data, &ii)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	problems := ii.DropInvalid()
+
+	for _, ind := range ii.Indicators {
+		if ind.Descriptor.Probability == 0.0 {
+			ind.Descriptor.Probability = 1.0
+		}
+	}
+
+	err = ii.Prepare()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &ii, problems, nil
+}
+
 // Loads indicators from a file.
 func LoadIndicatorsFromFile(path string) (*Indicators, error) {
 	data, err := ioutil.ReadFile(path)
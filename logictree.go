@@ -2,15 +2,52 @@ package indicators
 
 import (
 	"fmt"
+	"net"
+	"regexp"
+	"sort"
 )
 
-// An indicator term, can be one of or, and, not or type/value pair.
+// An indicator term, can be one of or, and, not, threshold, sequence or
+// type/value pair.  A type/value pair is an exact match unless Match says
+// otherwise, and if Count is set, is only true once it has matched Count
+// tokens.
+//
+// A threshold is true when at least AtLeast of the terms in Of are true.
+// Its FSM states record which of those terms are true, not just how many,
+// because a token seen twice must only count once; so AtLeast k of n
+// terms needs a state for every subset of fewer than k terms.  3 of 12
+// needs 79 states and compiles within the default limits; 8 of 24 would
+// need over half a million, and doesn't.
+//
+// A sequence is true when its terms become true in order; a token
+// advances a sequence by at most one step, even if it satisfies several
+// steps' match terms, except at 'end'.
+//
+// Within, if set, limits the time over which the term can be satisfied.
+// It is only supported on an indicator's top-level term, which must be an
+// and or a sequence, and validation rejects it on nested terms.
+// Occurrences of a term with a count are counted over everything a
+// Scanner sees, including tokens before the indicator's FSM leaves
+// 'init', and identical terms share a count, so count and within can't
+// be used together.
 type Term struct {
-	Type  string  `json:"type,omitempty"`
-	Value string  `json:"value,omitempty"`
-	And   []*Term `json:"and,omitempty"`
-	Or    []*Term `json:"or,omitempty"`
-	Not   *Term   `json:"not,omitempty"`
+	Type     string  `json:"type,omitempty"`
+	Value    string  `json:"value,omitempty"`
+	Match    string  `json:"match,omitempty"`
+	Count    int     `json:"count,omitempty"`
+	And      []*Term `json:"and,omitempty"`
+	Or       []*Term `json:"or,omitempty"`
+	Not      *Term   `json:"not,omitempty"`
+	AtLeast  int     `json:"atleast,omitempty"`
+	Of       []*Term `json:"of,omitempty"`
+	Sequence []*Term `json:"sequence,omitempty"`
+	Within   string  `json:"within,omitempty"`
+
+	// Compiled form of Value for regex terms.
+	re *regexp.Regexp
+
+	// Compiled form of Value for CIDR and range terms.
+	nets []*net.IPNet
 }
 
 // Dump a term
@@ -19,7 +56,7 @@ func (l *Term) Dump(indent int) {
 		for v := 0; v < indent+2; v++ {
 			fmt.Print("  ")
 		}
-		fmt.Println(l.Type, ":", l.Value)
+		fmt.Println(l.Token())
 		return
 	}
 	if len(l.And) > 0 {
@@ -50,6 +87,26 @@ func (l *Term) Dump(indent int) {
 		l.Not.Dump(indent + 1)
 		return
 	}
+	if len(l.Of) > 0 {
+		for v := 0; v < indent+2; v++ {
+			fmt.Print("  ")
+		}
+		fmt.Println("At least", l.AtLeast, "of")
+		for _, v := range l.Of {
+			v.Dump(indent + 1)
+		}
+		return
+	}
+	if len(l.Sequence) > 0 {
+		for v := 0; v < indent+2; v++ {
+			fmt.Print("  ")
+		}
+		fmt.Println("Sequence")
+		for _, v := range l.Sequence {
+			v.Dump(indent + 1)
+		}
+		return
+	}
 }
 
 // Returns true if this is an AND expression
@@ -67,6 +124,16 @@ func (l *Term) IsNot() bool {
 	return l.Not != nil
 }
 
+// Returns true if this is a threshold expression
+func (l *Term) IsThreshold() bool {
+	return len(l.Of) > 0
+}
+
+// Returns true if this is a sequence expression
+func (l *Term) IsSequence() bool {
+	return len(l.Sequence) > 0
+}
+
 // Returns true if this is a type/value expression
 func (l *Term) IsMatchTerm() bool {
 	return l.Type != "" && l.Value != ""
@@ -85,6 +152,16 @@ func (l *Term) RecordEnd(state *Combination, n *Navigator) {
 			v.RecordEnd(state, n)
 		}
 	}
+	if l.IsThreshold() {
+		for _, v := range l.Of {
+			v.RecordEnd(state, n)
+		}
+	}
+	if l.IsSequence() {
+		for _, v := range l.Sequence {
+			v.RecordEnd(state, n)
+		}
+	}
 	if l.IsNot() {
 		if state.Contains(l) {
 			return
@@ -105,70 +182,144 @@ func (l *Term) RecordEnd(state *Combination, n *Navigator) {
 
 // Evaluates a term's state when child state has changed
 func (l *Term) Evaluate(state *Combination, n *Navigator) {
+	l.evaluate(state, nil, n)
+}
 
-	if state.Contains(l) {
-		return
+// Evaluates a term's state when child state has changed because of a
+// token.  before is the state before the token was applied, and is used
+// so that a token advances a sequence by at most one step.  If before is
+// nil, a sequence may advance any number of steps, as at 'end'.
+func (l *Term) evaluate(state, before *Combination, n *Navigator) {
+	if l.settle(state, before, n) {
+		state.Add(l)
+		if parent := n.Parent[l]; parent != nil {
+			parent.evaluate(state, before, n)
+		}
 	}
+}
 
-	parent := n.Parent[l]
+// Works out whether a term has become true from its children's state,
+// without re-evaluating its parent.  Returns true if it has.  A sequence
+// which hasn't become true forgets steps which became true out of order.
+func (l *Term) settle(state, before *Combination, n *Navigator) bool {
 
-	if l.IsAnd() {
-		count := 0
-		for _, v := range l.And {
+	if state.Contains(l) {
+		return false
+	}
+
+	count := func(children []*Term) int {
+		c := 0
+		for _, v := range children {
 			if state.Contains(v) {
-				count++
+				c++
 			}
 		}
-		if count == len(l.And) {
-			state.Add(l)
-			if parent != nil {
-				parent.Evaluate(state, n)
-			}
-		}
-		return
+		return c
 	}
 
-	if l.IsOr() {
-		count := 0
-		for _, v := range l.Or {
-			if state.Contains(v) {
-				count++
-			}
+	switch {
+	case l.IsAnd():
+		return count(l.And) == len(l.And)
+	case l.IsOr():
+		return count(l.Or) > 0
+	case l.IsThreshold():
+		return count(l.Of) >= l.AtLeast
+	case !l.IsSequence():
+		return false
+	}
+
+	// Find the first step which isn't true.
+	done := 0
+	for done < len(l.Sequence) && state.Contains(l.Sequence[done]) {
+		done++
+	}
+
+	// Only the first step which wasn't true before the token may have
+	// become true, however many steps the token satisfies.
+	if before != nil {
+		next := 0
+		for next < len(l.Sequence) && before.Contains(l.Sequence[next]) {
+			next++
 		}
-		if count > 0 {
-			state.Add(l)
-			if parent != nil {
-				parent.Evaluate(state, n)
-			}
+		if done > next+1 {
+			done = next + 1
 		}
-		return
 	}
 
-	if l.IsNot() {
-		return
+	if done == len(l.Sequence) {
+		return true
 	}
 
-	if l.IsMatchTerm() {
-		return
+	// Any later step which is true has become true out of order, so is
+	// forgotten, and must become true again.
+	for _, v := range l.Sequence[done:] {
+		if state.Contains(v) {
+			v.Forget(state)
+		}
 	}
+	return false
 
 }
 
+// Removes a term and everything below it from a state.
+func (l *Term) Forget(state *Combination) {
+	l.Walk(func(v *Term, _ interface{}, _ *Term) error {
+		state.Delete(v)
+		return nil
+	})
+}
+
 // Works out state change based on activating a term - used when a match
 // term becomes true
 func (l *Term) Activate(state *Combination, n *Navigator) {
+	l.activate(state, nil, n)
+}
+
+// Activates a match term for a token, where before is the state before
+// the token was applied, see evaluate.
+func (l *Term) activate(state, before *Combination, n *Navigator) {
+	activateAll([]*Term{l}, state, before, n)
+}
 
-	if !l.IsMatchTerm() {
-		panic("Activate called on non-term")
+// Activates the match terms which one token satisfies, where before is
+// the state before the token was applied, see evaluate.  Every term is
+// made true before any term above them is evaluated, and each term above
+// is evaluated once, after its children, so the result doesn't depend on
+// the order of the terms.
+func activateAll(terms []*Term, state, before *Combination, n *Navigator) {
+
+	depth := map[*Term]int{}
+	for _, l := range terms {
+		if !l.IsMatchTerm() {
+			panic("Activate called on non-term")
+		}
+		if state.Contains(l) {
+			continue
+		}
+		state.Add(l)
+		above := []*Term{}
+		for p := n.Parent[l]; p != nil; p = n.Parent[p] {
+			above = append(above, p)
+		}
+		for i, p := range above {
+			depth[p] = len(above) - i
+		}
 	}
 
-	if state.Contains(l) {
-		return
+	deepest := make([]*Term, 0, len(depth))
+	for p := range depth {
+		deepest = append(deepest, p)
 	}
+	sort.Slice(deepest, func(a, b int) bool {
+		return depth[deepest[a]] > depth[deepest[b]]
+	})
 
-	state.Add(l)
-	if n.Parent[l] != nil {
-		n.Parent[l].Evaluate(state, n)
+	// Terms at the same depth are in separate subtrees, so their order
+	// doesn't matter.
+	for _, p := range deepest {
+		if p.settle(state, before, n) {
+			state.Add(p)
+		}
 	}
 
 }
@@ -197,6 +348,18 @@ func (l *Term) WalkState(wo WalkObserver, state interface{}, parent *Term) error
 			return err
 		}
 	}
+	for _, v := range l.Of {
+		err := v.WalkState(wo, state, l)
+		if err != nil {
+			return err
+		}
+	}
+	for _, v := range l.Sequence {
+		err := v.WalkState(wo, state, l)
+		if err != nil {
+			return err
+		}
+	}
 	err := wo(l, state, parent)
 	return err
 }
@@ -0,0 +1,184 @@
+package indicators
+
+import (
+	"testing"
+)
+
+// A token advances a sequence by at most one step, however many of its
+// steps it satisfies, and whatever order the steps' match terms sort in.
+func TestSequenceOneStepPerToken(t *testing.T) {
+
+	regex := &Term{Type: "url", Match: MatchRegex, Value: "x"}
+	exact := &Term{Type: "url", Value: "http://x/"}
+	url := Token{Type: "url", Value: "http://x/"}
+
+	for _, c := range []struct {
+		name   string
+		term   Term
+		tokens []Token
+		hit    bool
+	}{
+		{"regex then exact, one token",
+			Term{Sequence: []*Term{regex, exact}},
+			[]Token{url}, false},
+		{"exact then regex, one token",
+			Term{Sequence: []*Term{exact, regex}},
+			[]Token{url}, false},
+		{"regex then exact, two tokens",
+			Term{Sequence: []*Term{regex, exact}},
+			[]Token{url, url}, true},
+		{"exact then regex, two tokens",
+			Term{Sequence: []*Term{exact, regex}},
+			[]Token{url, url}, true},
+		{"repeated step, one token",
+			Term{Sequence: []*Term{exact, exact}},
+			[]Token{url}, false},
+		{"repeated step, two tokens",
+			Term{Sequence: []*Term{exact, exact}},
+			[]Token{url, url}, true},
+		// Each sequence advances by one step, so the first token
+		// also takes the inner sequence one step on.
+		{"nested sequences, one token",
+			Term{Sequence: []*Term{exact, {Sequence: []*Term{
+				regex, exact}}}},
+			[]Token{url}, false},
+		{"nested sequences, two tokens",
+			Term{Sequence: []*Term{exact, {Sequence: []*Term{
+				regex, exact}}}},
+			[]Token{url, url}, true},
+		{"steps which end satisfies together",
+			Term{Sequence: []*Term{{Not: regex},
+				{Not: &Term{Type: "url", Value: "y"}}}},
+			[]Token{EndToken}, true},
+	} {
+
+		if got := (&Indicator{Id: c.name, Term: *copyTerm(&c.term)}).
+			Oracle(c.tokens); got != c.hit {
+			t.Errorf("%s: oracle hit=%v, expected %v", c.name, got,
+				c.hit)
+		}
+
+		for _, product := range []bool{false, true} {
+			ii := &Indicators{Indicators: []*Indicator{
+				{Id: c.name, Term: *copyTerm(&c.term)},
+				// Shares an activator, so would share a
+				// product if the sequence could.
+				{Id: "other", Term: Term{Type: "url",
+					Value: "http://x/"}},
+			}}
+			if err := ii.Prepare(); err != nil {
+				t.Fatal(err)
+			}
+			opts := DefaultCompileOptions
+			opts.Product = product
+			rs, err := CreateRuleset(ii, &opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := rs.NewScanner()
+			for _, token := range c.tokens {
+				s.Update(token)
+			}
+			got := false
+			for _, ind := range s.GetHits() {
+				got = got || ind.Id == c.name
+			}
+			if got != c.hit {
+				t.Errorf("%s: scanner hit=%v, expected %v "+
+					"(product %v)", c.name, got, c.hit,
+					product)
+			}
+		}
+
+	}
+
+}
+
+func TestCompoundToken(t *testing.T) {
+
+	token := compoundToken([]Token{
+		{Type: "url", Match: MatchRegex, Value: "x"},
+		{Type: "url", Value: "http://x/"},
+	})
+	if s := token.String(); s != "{url:http://x/ & url:regex:x}" {
+		t.Errorf("unexpected form %q", s)
+	}
+	parts, err := token.components()
+	if err != nil || len(parts) != 2 || parts[0].Match != "" {
+		t.Errorf("components %v, %v", parts, err)
+	}
+
+}
+
+// A token's match terms are applied together, so where a sequence forgets
+// steps which became true out of order, the outcome doesn't depend on the
+// order the terms are in.
+func TestTermsActivatedTogether(t *testing.T) {
+
+	term := func(v string) *Term { return &Term{Type: "t", Value: v} }
+	regex := func() *Term {
+		return &Term{Type: "t", Match: MatchRegex, Value: "^[01]$"}
+	}
+	tokens := func(values ...string) []Token {
+		list := []Token{}
+		for _, v := range values {
+			list = append(list, Token{Type: "t", Value: v})
+		}
+		return append(list, EndToken)
+	}
+
+	for _, c := range []struct {
+		name   string
+		term   *Term
+		tokens []Token
+	}{
+		// t:0 satisfies every match term.  The outer sequence's
+		// first step can't be true before 'end', so the OR is
+		// forgotten along with the t:0 below its NOT, which then
+		// becomes true at 'end'.
+		{"forgotten negation", &Term{Sequence: []*Term{
+			{Not: &Term{Sequence: []*Term{term("0"), term("0")}}},
+			{Or: []*Term{regex(), {Not: term("0")}}},
+		}}, tokens("0")},
+		{"forgotten regex", &Term{Sequence: []*Term{
+			{Not: &Term{Sequence: []*Term{term("2"), regex()}}},
+			{Or: []*Term{regex(), term("1"), {Not: regex()}}},
+		}}, tokens("3", "1", "2", "2")},
+	} {
+
+		ind := prepared(c.term)
+		n := ind.BuildNavigator()
+
+		// Every order of the terms t:0 satisfies.
+		group := []*Term{}
+		for _, l := range n.Terms {
+			if l.Matches(Token{Type: "t", Value: "0"}) {
+				group = append(group, l)
+			}
+		}
+		reversed := []*Term{}
+		for i := len(group) - 1; i >= 0; i-- {
+			reversed = append(reversed, group[i])
+		}
+		a := ind.ExerciseTerms(NewCombination(), group, n)
+		b := ind.ExerciseTerms(NewCombination(), reversed, n)
+		same := len(a.ToArray()) == len(b.ToArray())
+		for _, l := range a.ToArray() {
+			same = same && b.Contains(l)
+		}
+		if !same {
+			t.Errorf("%s: result depends on term order", c.name)
+		}
+
+		rs, err := CreateRuleset(&Indicators{
+			Indicators: []*Indicator{ind}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !scanHits(rs, c.tokens) {
+			t.Errorf("%s: no hit", c.name)
+		}
+
+	}
+
+}
@@ -0,0 +1,284 @@
+package indicators
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Match term flavours, set in Term.Match.  An empty Match is the same as
+// MatchExact.
+const (
+	// Token value must equal the term value.
+	MatchExact = "exact"
+
+	// Token value must match the regular expression in the term value.
+	// The expression is not anchored, use ^ and $ to match the whole
+	// value.
+	MatchRegex = "regex"
+)
+
+// Returns the token which identifies this match term in an FSM.
+func (l *Term) Token() Token {
+	t := Token{Type: l.Type, Value: l.Value}
+	if l.Match != MatchExact {
+		t.Match = l.Match
+	}
+	if l.Count > 1 {
+		t.Count = l.Count
+	}
+	return t
+}
+
+// Returns true if a token satisfies this match term.  The token is
+// normalised first, so for exact matches the term value is expected to
+// have been normalised by Prepare.  Count is not considered: the result
+// says whether the token counts towards the term.
+func (l *Term) Matches(token Token) bool {
+
+	if token.Type != l.Type {
+		return false
+	}
+
+	token = Normalise(token)
+
+	switch l.Match {
+	case MatchRegex:
+		re := l.re
+		if re == nil {
+			var err error
+			re, err = regexp.Compile(l.Value)
+			if err != nil {
+				return false
+			}
+		}
+		return re.MatchString(token.Value)
+	case MatchCIDR, MatchRange:
+		nets := l.nets
+		if nets == nil {
+			var err error
+			nets, err = parsePrefixes(l.Type, l.Match, l.Value)
+			if err != nil {
+				return false
+			}
+		}
+		addr := parseAddress(token.Type, token.Value)
+		if addr == nil {
+			return false
+		}
+		for _, block := range nets {
+			if block.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	case MatchSuffix:
+		suffix, err := canonicalDomain(l.Value)
+		if err != nil {
+			return false
+		}
+		domain, err := canonicalDomain(token.Value)
+		if err != nil {
+			return false
+		}
+		return domain == suffix ||
+			strings.HasSuffix(domain, "."+suffix)
+	default:
+		return token.Value == l.Value
+	}
+
+}
+
+// Checks the match flavour of a match term, normalises exact match
+// values, and compiles anything which needs compiling.
+func (l *Term) compileMatch() error {
+
+	switch l.Match {
+	case "", MatchExact:
+		l.Value = Normalise(Token{Type: l.Type, Value: l.Value}).Value
+		return nil
+	case MatchRegex:
+		re, err := regexp.Compile(l.Value)
+		if err != nil {
+			return fmt.Errorf("invalid regex %q: %v", l.Value, err)
+		}
+		l.re = re
+		return nil
+	case MatchCIDR, MatchRange:
+		nets, err := parsePrefixes(l.Type, l.Match, l.Value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", l.Match, l.Value,
+				err)
+		}
+		l.nets = nets
+		return nil
+	case MatchSuffix:
+		if !isDomainType(l.Type) {
+			return fmt.Errorf("suffix match not supported for "+
+				"type %q", l.Type)
+		}
+		_, err := canonicalDomain(l.Value)
+		if err != nil {
+			return fmt.Errorf("invalid domain %q: %v", l.Value, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown match type %q", l.Match)
+	}
+
+}
+
+// Prepares indicators for use after loading, normalising the values of
+// exact match terms, compiling regex and other terms, and simplifying term
+// trees.  Indicators are validated first, and a *ValidationError listing
+// every problem is returned if any are found.  LoadIndicators calls this;
+// it only needs to be called directly for indicators which are
+// constructed in code.
+func (ii *Indicators) Prepare() error {
+	if problems := ii.Validate(); len(problems) > 0 {
+		return &ValidationError{problems}
+	}
+	for _, ind := range ii.Indicators {
+		err := ind.Walk(func(l *Term, _ interface{}, _ *Term) error {
+			if l.IsMatchTerm() {
+				return l.compileMatch()
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("indicator %s: %v", ind.Id, err)
+		}
+		ind.Simplify()
+	}
+	return nil
+}
+
+// A regex match term, indexed by the Ruleset for scanning.
+type regexSymbol struct {
+	re     *regexp.Regexp
+	symbol int32
+}
+
+// Matchers for tokens which can't be found by exact lookup in the symbol
+// table.  Built from the symbol table, so that it needn't be saved.
+type matchIndex struct {
+
+	// Regex terms, by token type.
+	regexes map[string][]regexSymbol
+
+	// CIDR and range terms, by token type.
+	prefixes map[string]*prefixTrie
+
+	// Domain suffix terms, by token type.
+	suffixes map[string]*suffixTrie
+
+	// Exact match terms with a count, by the token they match.
+	counted map[Token][]int32
+}
+
+// Builds the index of non-exact match terms from the symbol table.
+func (r *Ruleset) IndexMatchers() error {
+
+	r.matchers = matchIndex{
+		regexes:  map[string][]regexSymbol{},
+		prefixes: map[string]*prefixTrie{},
+		suffixes: map[string]*suffixTrie{},
+		counted:  map[Token][]int32{},
+	}
+
+	for sym, token := range r.Symbols.Tokens {
+		switch token.Match {
+		case "":
+			if token.Count > 1 {
+				plain := Token{Type: token.Type,
+					Value: token.Value}
+				r.matchers.counted[plain] = append(
+					r.matchers.counted[plain], int32(sym))
+			}
+		case MatchRegex:
+			re, err := regexp.Compile(token.Value)
+			if err != nil {
+				return err
+			}
+			r.matchers.regexes[token.Type] = append(
+				r.matchers.regexes[token.Type],
+				regexSymbol{re, int32(sym)})
+		case MatchCIDR, MatchRange:
+			blocks, err := parsePrefixes(token.Type, token.Match,
+				token.Value)
+			if err != nil {
+				return err
+			}
+			trie, ok := r.matchers.prefixes[token.Type]
+			if !ok {
+				trie = &prefixTrie{}
+				r.matchers.prefixes[token.Type] = trie
+			}
+			for _, block := range blocks {
+				trie.insert(block, int32(sym))
+			}
+		case MatchSuffix:
+			domain, err := canonicalDomain(token.Value)
+			if err != nil {
+				return err
+			}
+			trie, ok := r.matchers.suffixes[token.Type]
+			if !ok {
+				trie = &suffixTrie{}
+				r.matchers.suffixes[token.Type] = trie
+			}
+			trie.insert(domain, int32(sym))
+		}
+	}
+
+	return nil
+
+}
+
+// Returns the symbols for all match terms which token satisfies, appended
+// to syms.  The token is normalised before matching, by the normalisers
+// registered when the Ruleset was created or loaded.  Symbols are returned
+// in the order of their tokens, see tokenLess, which is the order in which
+// compound tokens list them.
+func (r *Ruleset) Resolve(token Token, syms []int32) []int32 {
+
+	start := len(syms)
+	if n, ok := r.normalisers[token.Type]; ok {
+		token.Value = n(token.Value)
+	}
+	if sym, ok := r.Symbols.Lookup(token); ok {
+		syms = append(syms, sym)
+	}
+
+	syms = append(syms, r.matchers.counted[token]...)
+
+	for _, v := range r.matchers.regexes[token.Type] {
+		if v.re.MatchString(token.Value) {
+			syms = append(syms, v.symbol)
+		}
+	}
+
+	if trie, ok := r.matchers.prefixes[token.Type]; ok {
+		if addr := parseAddress(token.Type, token.Value); addr != nil {
+			syms = trie.lookup(addr, syms)
+		}
+	}
+
+	if trie, ok := r.matchers.suffixes[token.Type]; ok {
+		if domain, err := canonicalDomain(token.Value); err == nil {
+			syms = trie.lookup(domain, syms)
+		}
+	}
+
+	if len(syms)-start > 1 {
+		found := syms[start:]
+		sort.Slice(found, func(a, b int) bool {
+			return tokenLess(r.Symbols.Tokens[found[a]],
+				r.Symbols.Tokens[found[b]])
+		})
+	}
+
+	return syms
+
+}
@@ -0,0 +1,217 @@
+package indicators
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Sizes of an FSM before and after minimisation.
+type MinimiseStats struct {
+	StatesBefore      int
+	StatesAfter       int
+	TransitionsBefore int
+	TransitionsAfter  int
+}
+
+// Adds another set of statistics to this one.
+func (s *MinimiseStats) Add(o MinimiseStats) {
+	s.StatesBefore += o.StatesBefore
+	s.StatesAfter += o.StatesAfter
+	s.TransitionsBefore += o.TransitionsBefore
+	s.TransitionsAfter += o.TransitionsAfter
+}
+
+func (s MinimiseStats) String() string {
+	return fmt.Sprintf("states %d -> %d, transitions %d -> %d",
+		s.StatesBefore, s.StatesAfter, s.TransitionsBefore,
+		s.TransitionsAfter)
+}
+
+// Counts the states and token transitions of an FSM.
+func (fsm *Fsm) size() (int, int) {
+	states := map[string]bool{"init": true, "hit": true, "fail": true}
+	transitions := 0
+	for _, v := range fsm.Transitions {
+		states[v.Current] = true
+		states[v.Next] = true
+		transitions += len(v.Token)
+	}
+	return len(states), transitions
+}
+
+// Merges states which behave the same for every sequence of tokens, and
+// drops states which can't be reached, so that the FSM has as few states
+// as possible.  'hit' and 'fail' are never merged with anything else.  A
+// token with no transition leaves the state unchanged, and that is taken
+// into account when comparing states.  Merged states take the name of
+// 'init', if it is one of them, or otherwise the first name in sort
+// order.  Call after RemoveInvalidTransitions.
+func (fsm *Fsm) Minimise() MinimiseStats {
+	stats, _ := fsm.minimise(func() bool { return false })
+	return stats
+}
+
+// As Minimise, but gives up, returning false and leaving the FSM
+// unchanged, if expired reports that the time budget has run out.
+func (fsm *Fsm) minimise(expired func() bool) (MinimiseStats, bool) {
+
+	var stats MinimiseStats
+	stats.StatesBefore, stats.TransitionsBefore = fsm.size()
+
+	// States which can't be reached from 'init' are dropped.  Some
+	// are left by RemoveInvalidTransitions, when the only way in was
+	// relabelled as a transition to 'fail'.
+	out := map[string][]string{}
+	for _, v := range fsm.Transitions {
+		out[v.Current] = append(out[v.Current], v.Next)
+	}
+	reachable := map[string]bool{"init": true}
+	queue := []string{"init"}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for _, to := range out[state] {
+			if !reachable[to] {
+				reachable[to] = true
+				queue = append(queue, to)
+			}
+		}
+	}
+	live := []FsmTransition{}
+	for _, v := range fsm.Transitions {
+		if reachable[v.Current] {
+			live = append(live, v)
+		}
+	}
+	if expired() {
+		return stats, false
+	}
+
+	// Index transitions by state and token.
+	next := map[string]map[Token]string{}
+	names := []string{"init", "hit", "fail"}
+	seen := map[string]bool{"init": true, "hit": true, "fail": true}
+	tokens := []Token{}
+	seenToken := map[Token]bool{}
+	for _, v := range live {
+		for _, name := range []string{v.Current, v.Next} {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		if next[v.Current] == nil {
+			next[v.Current] = map[Token]string{}
+		}
+		for _, token := range v.Token {
+			next[v.Current][token] = v.Next
+			if !seenToken[token] {
+				seenToken[token] = true
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	sort.Strings(names[3:])
+	sort.Slice(tokens, func(a, b int) bool {
+		return tokenLess(tokens[a], tokens[b])
+	})
+
+	// Moore's algorithm: start with 'hit', 'fail' and everything else
+	// in separate blocks, and split blocks until every state in a block
+	// goes to the same blocks as the others, token by token.
+	block := map[string]int{}
+	for _, name := range names {
+		switch name {
+		case "hit":
+			block[name] = 1
+		case "fail":
+			block[name] = 2
+		default:
+			block[name] = 0
+		}
+	}
+	blocks := 3
+
+	for {
+		signatures := map[string]int{}
+		refined := map[string]int{}
+		for _, name := range names {
+			var sig strings.Builder
+			fmt.Fprint(&sig, block[name])
+			for _, token := range tokens {
+				to, ok := next[name][token]
+				if !ok {
+					to = name
+				}
+				fmt.Fprint(&sig, ",", block[to])
+			}
+			id, ok := signatures[sig.String()]
+			if !ok {
+				id = len(signatures)
+				signatures[sig.String()] = id
+			}
+			refined[name] = id
+		}
+		block = refined
+		if len(signatures) == blocks {
+			break
+		}
+		blocks = len(signatures)
+		if expired() {
+			return stats, false
+		}
+	}
+
+	// Name each block after its first state.  Names are sorted after
+	// 'init', 'hit' and 'fail', so those keep their names.
+	rep := map[int]string{}
+	for _, name := range names {
+		if _, ok := rep[block[name]]; !ok {
+			rep[block[name]] = name
+		}
+	}
+
+	// Note which states each representative stands for, including any
+	// merged by an earlier minimisation.
+	merged := map[string][]string{}
+	for _, name := range names {
+		r := rep[block[name]]
+		if r != name {
+			merged[r] = append(merged[r], name)
+		}
+		merged[r] = append(merged[r], fsm.Merged[name]...)
+	}
+	for r := range merged {
+		if len(merged[r]) == 0 {
+			delete(merged, r)
+		}
+	}
+	fsm.Merged = merged
+
+	// Rebuild transitions from each block's representative, dropping
+	// transitions which stay in the block.
+	transitions := []FsmTransition{}
+	for _, name := range names {
+		if rep[block[name]] != name {
+			continue
+		}
+		for _, token := range tokens {
+			to, ok := next[name][token]
+			if !ok || block[to] == block[name] {
+				continue
+			}
+			transitions = append(transitions, FsmTransition{
+				Current: name,
+				Token:   []Token{token},
+				Next:    rep[block[to]],
+			})
+		}
+	}
+	fsm.Transitions = transitions
+	fsm.Flatten()
+
+	stats.StatesAfter, stats.TransitionsAfter = fsm.size()
+	return stats, true
+
+}
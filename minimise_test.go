@@ -0,0 +1,117 @@
+package indicators
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Builds a Ruleset directly from one FSM.
+func ruleset(ind *Indicator, fsm *Fsm) *Ruleset {
+	rs := &Ruleset{
+		Indicators: []*Indicator{ind},
+		Symbols:    NewSymbolTable(),
+	}
+	rs.Fsms = []*StateTable{fsm.Tabulate(rs.Symbols)}
+	if err := rs.index(); err != nil {
+		panic(err)
+	}
+	return rs
+}
+
+// Checks that the minimised FSM reaches 'hit' and 'fail' on the same
+// tokens as the FSM before minimisation.
+func checkMinimised(tc testCase) string {
+
+	ind := prepared(tc.term)
+	if ind == nil {
+		return ""
+	}
+
+	n := ind.BuildNavigator()
+	fsm, err := ind.ExploreTransitions(n.Terms, n, nil)
+	if err != nil {
+		return fmt.Sprintf("compile failed: %v", err)
+	}
+	fsm.Flatten()
+	fsm.RemoveInvalidTransitions(n)
+	before := ruleset(ind, fsm).NewScanner()
+
+	fsm.Minimise()
+	after := ruleset(ind, fsm).NewScanner()
+
+	for i, t := range tc.tokens {
+		before.Update(t)
+		after.Update(t)
+		b, _ := before.StateOf(0)
+		a, _ := after.StateOf(0)
+		if (b == StateHit) != (a == StateHit) ||
+			(b == StateFail) != (a == StateFail) {
+			return fmt.Sprintf("after token %d, FSM is in %s, "+
+				"minimised FSM is in %s", i,
+				before.Ruleset.Fsms[0].States[b],
+				after.Ruleset.Fsms[0].States[a])
+		}
+	}
+	return ""
+
+}
+
+func TestMinimisePreservesBehaviour(t *testing.T) {
+	generated(t, checkMinimised)
+}
+
+func TestMinimise(t *testing.T) {
+
+	// Once 'a' has been seen, the states for a OR b are all the same.
+	ind := &Indicator{Id: "or", Term: Term{Or: []*Term{
+		{And: []*Term{
+			{Type: "t", Value: "a"},
+			{Type: "t", Value: "b"},
+		}},
+		{And: []*Term{
+			{Type: "t", Value: "a"},
+			{Type: "t", Value: "c"},
+		}},
+	}}}
+	fsm := ind.GenerateFsmLazy()
+	stats := fsm.Minimised
+	if stats.StatesAfter >= stats.StatesBefore {
+		t.Errorf("no states merged: %v", stats)
+	}
+	if states, _ := fsm.size(); states != stats.StatesAfter {
+		t.Errorf("FSM has %d states, stats say %d", states,
+			stats.StatesAfter)
+	}
+
+	// Minimising again changes nothing.
+	again := fsm.Minimise()
+	if again.StatesBefore != again.StatesAfter ||
+		again.TransitionsBefore != again.TransitionsAfter {
+		t.Errorf("second minimisation changed the FSM: %v", again)
+	}
+
+}
+
+// States only reachable through transitions relabelled to 'fail' are
+// dropped.
+func TestMinimiseDropsUnreachable(t *testing.T) {
+
+	fsm := &Fsm{Transitions: []FsmTransition{
+		{Current: "init", Token: []Token{{Type: "t", Value: "a"}},
+			Next: "hit"},
+		{Current: "init", Token: []Token{{Type: "t", Value: "b"}},
+			Next: "fail"},
+		{Current: "s1", Token: []Token{{Type: "t", Value: "a"}},
+			Next: "hit"},
+	}}
+	stats := fsm.Minimise()
+	if stats.StatesAfter != 3 {
+		t.Errorf("expected 3 states, got %v", stats)
+	}
+	for _, v := range fsm.Transitions {
+		if v.Current == "s1" {
+			t.Errorf("unreachable state kept: %v", v)
+		}
+	}
+
+}
@@ -25,8 +25,14 @@ type Navigator struct {
 	Terms []*Term
 }
 
-// Constructs a navigator from a term tree.
+// Constructs a navigator from the term tree which is compiled, see
+// Simplify.
 func (i *Indicator) BuildNavigator() *Navigator {
+	return i.root().navigator()
+}
+
+// Constructs a navigator from a term tree.
+func (l *Term) navigator() *Navigator {
 
 	// Allocate Navigator.
 	n := &Navigator{
@@ -39,7 +45,7 @@ func (i *Indicator) BuildNavigator() *Navigator {
 	next_id := 1
 
 	// Walk the term tree, collecting information
-	i.Walk(func(l *Term, state interface{}, par *Term) error {
+	l.Walk(func(l *Term, state interface{}, par *Term) error {
 		state_id := "s" + strconv.Itoa(next_id)
 		next_id++
 		n.StateName[l] = state_id
@@ -49,8 +55,19 @@ func (i *Indicator) BuildNavigator() *Navigator {
 	})
 
 	// Collect state information
-	n.BasicStates, n.Terms = i.DiscoverStates(n)
+	n.BasicStates, n.Terms = l.discoverStates(n)
 
 	return n
 
 }
+
+// Returns true if a term is below a threshold term which is true in the
+// given state.
+func (n *Navigator) BelowThreshold(l *Term, state *Combination) bool {
+	for p := n.Parent[l]; p != nil; p = n.Parent[p] {
+		if p.IsThreshold() && state.Contains(p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package indicators
+
+import (
+	"net"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Normaliser converts a token value to canonical form.  Values which
+// can't be normalised e.g. because they are malformed should be returned
+// unchanged.
+type Normaliser func(value string) string
+
+var (
+	normalisersLock sync.RWMutex
+
+	// Normalisers by token type.
+	normalisers = map[string]Normaliser{
+		"url":      NormaliseURL,
+		"hostname": NormaliseDomain,
+		"domain":   NormaliseDomain,
+		"fqdn":     NormaliseDomain,
+		"email":    strings.ToLower,
+		"hash":     strings.ToLower,
+		"ipv4":     NormaliseIPv4,
+		"ipv6":     NormaliseIPv6,
+		"mac":      NormaliseMAC,
+	}
+)
+
+// Registers a Normaliser for a token type, replacing any existing one.  A
+// nil Normaliser removes normalisation for the type.  The same
+// normalisation must be in place when indicators are loaded and when
+// tokens are scanned, so this should be called before loading indicators.
+// A Ruleset keeps the normalisers registered when it was created or
+// loaded, and isn't affected by later calls.
+func RegisterNormaliser(typ string, n Normaliser) {
+	normalisersLock.Lock()
+	defer normalisersLock.Unlock()
+	if n == nil {
+		delete(normalisers, typ)
+	} else {
+		normalisers[typ] = n
+	}
+}
+
+// Returns a copy of the registered normalisers.
+func registeredNormalisers() map[string]Normaliser {
+	normalisersLock.RLock()
+	defer normalisersLock.RUnlock()
+	set := make(map[string]Normaliser, len(normalisers))
+	for typ, n := range normalisers {
+		set[typ] = n
+	}
+	return set
+}
+
+// Returns the token types with registered normalisers, in order.
+func normalisedTypes(set map[string]Normaliser) []string {
+	types := make([]string, 0, len(set))
+	for typ := range set {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Returns a token with its value normalised according to its type.
+func Normalise(token Token) Token {
+	normalisersLock.RLock()
+	n, ok := normalisers[token.Type]
+	normalisersLock.RUnlock()
+	if ok {
+		token.Value = n(token.Value)
+	}
+	return token
+}
+
+// Normalises a URL: the scheme and host are lower-cased, default ports
+// are removed, and an empty path becomes "/".
+// e.g. HTTP://WWW.Malware.org:80 -> http://www.malware.org/
+func NormaliseURL(value string) string {
+
+	u, err := url.Parse(strings.TrimSpace(value))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return value
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") ||
+		(u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host = host + ":" + port
+	}
+	u.Host = host
+
+	if u.Path == "" && u.RawPath == "" && u.Opaque == "" {
+		u.Path = "/"
+	}
+
+	return u.String()
+
+}
+
+// Normalises a domain name, see canonicalDomain.
+func NormaliseDomain(value string) string {
+	domain, err := canonicalDomain(value)
+	if err != nil {
+		return value
+	}
+	return domain
+}
+
+// Normalises an IPv4 address, removing leading zeroes from octets
+// e.g. 10.0.2.015 -> 10.0.2.15.  Octets are always treated as decimal.
+func NormaliseIPv4(value string) string {
+	octets := strings.Split(strings.TrimSpace(value), ".")
+	if len(octets) != 4 {
+		return value
+	}
+	for i, v := range octets {
+		if v == "" || strings.TrimLeft(v, "0123456789") != "" {
+			return value
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n > 255 {
+			return value
+		}
+		octets[i] = strconv.Itoa(n)
+	}
+	return strings.Join(octets, ".")
+}
+
+// Normalises an IPv6 address to the compressed form in RFC 5952
+// e.g. 2001:0DB8:0:0:0:0:0:1 -> 2001:db8::1.  IPv4-mapped addresses stay
+// IPv6 addresses, written with the IPv4 part dotted e.g.
+// ::FFFF:0A00:0001 -> ::ffff:10.0.0.1.
+func NormaliseIPv6(value string) string {
+	addr, err := netip.ParseAddr(strings.TrimSpace(value))
+	if err != nil || !addr.Is6() {
+		return value
+	}
+	return addr.String()
+}
+
+// Normalises a MAC address to lower-case colon-separated form
+// e.g. 00-1A-2B-3C-4D-5E -> 00:1a:2b:3c:4d:5e.
+func NormaliseMAC(value string) string {
+	mac, err := net.ParseMAC(strings.TrimSpace(value))
+	if err != nil {
+		return value
+	}
+	return mac.String()
+}
@@ -0,0 +1,53 @@
+package indicators
+
+import (
+	"testing"
+)
+
+func TestNormaliseIPv6(t *testing.T) {
+	for _, c := range []struct {
+		value, expect string
+	}{
+		{"2001:0DB8:0:0:0:0:0:1", "2001:db8::1"},
+		{" 2001:db8:0:0:1:0:0:1 ", "2001:db8::1:0:0:1"},
+		{"2001:db8::0:1", "2001:db8::1"},
+		{"::1", "::1"},
+		{"::FFFF:0A00:0001", "::ffff:10.0.0.1"},
+		{"::ffff:10.0.0.1", "::ffff:10.0.0.1"},
+		{"10.0.0.1", "10.0.0.1"},
+		{"2001:db8::g", "2001:db8::g"},
+	} {
+		if got := NormaliseIPv6(c.value); got != c.expect {
+			t.Errorf("%q: expected %s, got %s", c.value, c.expect,
+				got)
+		}
+	}
+}
+
+// IPv4-mapped addresses are matched as IPv6 addresses, however they're
+// written.
+func TestMappedIPv6(t *testing.T) {
+
+	ii, err := LoadIndicators([]byte(`{"indicators": [
+		{"id": "mapped", "type": "ipv6", "value": "::ffff:10.0.0.1"},
+		{"id": "ipv4", "type": "ipv4", "value": "10.0.0.1"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := CreateRuleset(ii, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range []string{"::ffff:10.0.0.1", "::FFFF:A00:1",
+		"0:0:0:0:0:ffff:10.0.0.1"} {
+		s := rs.NewScanner()
+		s.Update(Token{Type: "ipv6", Value: value})
+		hits := s.GetHits()
+		if len(hits) != 1 || hits[0].Id != "mapped" {
+			t.Errorf("%s: wrong hits %v", value, hits)
+		}
+	}
+
+}
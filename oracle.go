@@ -0,0 +1,208 @@
+package indicators
+
+// State of a direct evaluation of a term tree.
+type oracle struct {
+	root   *Term
+	parent map[*Term]*Term
+	terms  []*Term
+	state  map[*Term]bool
+	counts map[Token]int
+
+	// The state before the current token was applied, or nil at
+	// 'end'.
+	before map[*Term]bool
+}
+
+// Evaluates an indicator's term tree as written directly against a stream
+// of tokens, without compiling it to an FSM, and returns true if the
+// indicator hits.  A token with type "end" marks the end of the stream, at
+// which point NOT terms whose negated term is false become true.  This is
+// a reference for testing the FSM compiler: it is much slower than a
+// Scanner, and ignores time windows.  Where one token satisfies several
+// match terms, they are applied together: the token advances a sequence
+// by at most one step, however many of its steps it satisfies.
+func (i *Indicator) Oracle(tokens []Token) bool {
+
+	o := &oracle{
+		root:   &i.Term,
+		parent: map[*Term]*Term{},
+		state:  map[*Term]bool{},
+		counts: map[Token]int{},
+	}
+
+	i.Walk(func(l *Term, _ interface{}, par *Term) error {
+		o.parent[l] = par
+		if l.IsMatchTerm() {
+			o.terms = append(o.terms, l)
+		}
+		return nil
+	})
+
+	for _, token := range tokens {
+		if token.Type == EndToken.Type {
+			o.end(o.root)
+		} else {
+			o.token(token)
+		}
+		if o.state[o.root] {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+// Applies a token to all match terms it satisfies.
+func (o *oracle) token(token Token) {
+
+	matched := []*Term{}
+	counted := map[Token]bool{}
+
+	for _, l := range o.terms {
+		if !l.Matches(token) {
+			continue
+		}
+		matched = append(matched, l)
+
+		// Identical terms share a count, and a token counts once.
+		if key := l.Token(); key.Count > 1 && !counted[key] {
+			counted[key] = true
+			if o.counts[key] < key.Count {
+				o.counts[key]++
+			}
+		}
+	}
+
+	o.before = map[*Term]bool{}
+	for l, v := range o.state {
+		o.before[l] = v
+	}
+
+	// Every matched term is made true before anything above them is
+	// re-evaluated, so that the order of the terms doesn't matter.
+	for _, l := range matched {
+		if key := l.Token(); key.Count > 1 && o.counts[key] < key.Count {
+			continue
+		}
+		o.state[l] = true
+	}
+	o.settle(o.root)
+
+	o.before = nil
+
+}
+
+// Re-evaluates a term tree after a token, children before parents.
+func (o *oracle) settle(l *Term) {
+	for _, list := range [][]*Term{l.And, l.Or, l.Of, l.Sequence} {
+		for _, v := range list {
+			o.settle(v)
+		}
+	}
+	if l.Not != nil {
+		o.settle(l.Not)
+	}
+	if o.evaluate(l) {
+		o.state[l] = true
+	}
+}
+
+// Makes a term true, and re-evaluates its parent.
+func (o *oracle) set(l *Term) {
+	if o.state[l] {
+		return
+	}
+	o.state[l] = true
+	if p := o.parent[l]; p != nil && o.evaluate(p) {
+		o.set(p)
+	}
+}
+
+// Works out whether a term has become true from its children.  A
+// sequence which hasn't forgets steps which became true out of order.
+func (o *oracle) evaluate(l *Term) bool {
+
+	if o.state[l] {
+		return false
+	}
+
+	count := func(children []*Term) int {
+		n := 0
+		for _, v := range children {
+			if o.state[v] {
+				n++
+			}
+		}
+		return n
+	}
+
+	switch {
+	case l.IsAnd():
+		return count(l.And) == len(l.And)
+	case l.IsOr():
+		return count(l.Or) > 0
+	case l.IsThreshold():
+		return count(l.Of) >= l.AtLeast
+	case !l.IsSequence():
+		return false
+	}
+
+	done := 0
+	for done < len(l.Sequence) && o.state[l.Sequence[done]] {
+		done++
+	}
+	// A token completes at most the first step which wasn't true
+	// before it.
+	if o.before != nil {
+		next := 0
+		for next < len(l.Sequence) && o.before[l.Sequence[next]] {
+			next++
+		}
+		if done > next+1 {
+			done = next + 1
+		}
+	}
+	if done == len(l.Sequence) {
+		return true
+	}
+	// Steps which became true out of order are forgotten, along with
+	// everything below them.
+	for _, v := range l.Sequence[done:] {
+		if !o.state[v] {
+			continue
+		}
+		v.Walk(func(t *Term, _ interface{}, _ *Term) error {
+			delete(o.state, t)
+			return nil
+		})
+	}
+	return false
+
+}
+
+// Applies 'end' to a term tree: a NOT term becomes true if its negated
+// term is still false once 'end' has been applied to it.
+func (o *oracle) end(l *Term) {
+
+	for _, v := range l.And {
+		o.end(v)
+	}
+	for _, v := range l.Or {
+		o.end(v)
+	}
+	for _, v := range l.Of {
+		o.end(v)
+	}
+	for _, v := range l.Sequence {
+		o.end(v)
+	}
+
+	if l.IsNot() && !o.state[l] {
+		o.end(l.Not)
+		if !o.state[l.Not] {
+			o.set(l)
+		}
+	}
+
+}
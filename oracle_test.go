@@ -0,0 +1,358 @@
+package indicators
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Generated test cases use a different seed each run, unless -seed is
+// given, e.g. to repeat a failure.  The seed is logged.
+var (
+	seed = flag.Int64("seed", 0,
+		"random seed for generated test cases, 0 for the time")
+	cases = flag.Int("cases", 2000, "number of generated test cases")
+)
+
+// Token values are drawn from a small vocabulary, so that trees contain
+// repeated terms and streams repeat tokens.
+const vocab = 4
+
+// Generates random term trees and token streams.
+type generator struct {
+	rng *rand.Rand
+}
+
+// Regex terms over the vocabulary, so that one token can satisfy several
+// different match terms.
+var patterns = []string{"^[01]$", "^[12]$", "^[0-3]$"}
+
+func (g *generator) leaf() *Term {
+	t := &Term{Type: "t", Value: strconv.Itoa(g.rng.Intn(vocab))}
+	if g.rng.Intn(5) == 0 {
+		t.Match = MatchRegex
+		t.Value = patterns[g.rng.Intn(len(patterns))]
+	}
+	if g.rng.Intn(10) == 0 {
+		t.Count = 2
+	}
+	return t
+}
+
+func (g *generator) children(depth, min, max int) []*Term {
+	n := min + g.rng.Intn(max-min+1)
+	terms := make([]*Term, n)
+	for i := range terms {
+		terms[i] = g.term(depth - 1)
+	}
+	return terms
+}
+
+// Generates a random term tree.
+func (g *generator) term(depth int) *Term {
+
+	if depth <= 0 || g.rng.Intn(3) == 0 {
+		return g.leaf()
+	}
+
+	switch g.rng.Intn(6) {
+	case 0:
+		return &Term{And: g.children(depth, 1, 3)}
+	case 1:
+		return &Term{Or: g.children(depth, 1, 3)}
+	case 2:
+		return &Term{Not: g.term(depth - 1)}
+	case 3:
+		of := g.children(depth, 2, 4)
+		return &Term{Of: of, AtLeast: 1 + g.rng.Intn(len(of))}
+	case 4:
+		return &Term{Sequence: g.children(depth, 2, 3)}
+	default:
+		// A term alongside its own negation, which simplification
+		// treats specially.
+		t := g.term(depth - 1)
+		pair := []*Term{t, {Not: copyTerm(t)}}
+		if g.rng.Intn(2) == 0 {
+			return &Term{And: pair}
+		}
+		return &Term{Or: pair}
+	}
+
+}
+
+// Generates a random token stream, always ending with 'end'.
+func (g *generator) stream() []Token {
+	tokens := []Token{}
+	for n := g.rng.Intn(8); n > 0; n-- {
+		tokens = append(tokens, Token{Type: "t",
+			Value: strconv.Itoa(g.rng.Intn(vocab))})
+	}
+	return append(tokens, EndToken)
+}
+
+// A test case: an indicator and a token stream.
+type testCase struct {
+	term   *Term
+	tokens []Token
+}
+
+func copyTerm(t *Term) *Term {
+	data, _ := json.Marshal(t)
+	var c Term
+	json.Unmarshal(data, &c)
+	return &c
+}
+
+// Returns all the ways of making a term tree slightly smaller.
+func shrinkTerm(t *Term) []*Term {
+
+	out := []*Term{}
+
+	lists := func(t *Term) []*[]*Term {
+		return []*[]*Term{&t.And, &t.Or, &t.Of, &t.Sequence}
+	}
+
+	// Replace the node by one of its children.
+	for _, list := range lists(t) {
+		for _, v := range *list {
+			out = append(out, copyTerm(v))
+		}
+	}
+	if t.Not != nil {
+		out = append(out, copyTerm(t.Not))
+	}
+
+	// Drop a child, or shrink a child.
+	for l := range lists(t) {
+		n := len(*lists(t)[l])
+		for i := 0; i < n; i++ {
+			if n > 1 {
+				c := copyTerm(t)
+				list := lists(c)[l]
+				*list = append((*list)[:i], (*list)[i+1:]...)
+				if c.AtLeast > len(c.Of) {
+					c.AtLeast = len(c.Of)
+				}
+				out = append(out, c)
+			}
+			for _, smaller := range shrinkTerm((*lists(t)[l])[i]) {
+				c := copyTerm(t)
+				(*lists(c)[l])[i] = smaller
+				out = append(out, c)
+			}
+		}
+	}
+	if t.Not != nil {
+		for _, smaller := range shrinkTerm(t.Not) {
+			c := copyTerm(t)
+			c.Not = smaller
+			out = append(out, c)
+		}
+	}
+
+	// Lower a threshold, or drop a count.
+	if t.AtLeast > 1 {
+		c := copyTerm(t)
+		c.AtLeast--
+		out = append(out, c)
+	}
+	if t.Count > 0 {
+		c := copyTerm(t)
+		c.Count = 0
+		out = append(out, c)
+	}
+
+	return out
+
+}
+
+// Shrinks a failing test case until no smaller case fails check.
+func shrink(tc testCase, check func(testCase) string) testCase {
+	for {
+		smaller := false
+
+		// Try dropping tokens, other than the final 'end'.
+		for i := 0; i < len(tc.tokens)-1 && !smaller; i++ {
+			tokens := append(append([]Token{},
+				tc.tokens[:i]...), tc.tokens[i+1:]...)
+			c := testCase{tc.term, tokens}
+			if check(c) != "" {
+				tc, smaller = c, true
+			}
+		}
+
+		for _, t := range shrinkTerm(tc.term) {
+			if smaller {
+				break
+			}
+			c := testCase{t, tc.tokens}
+			if check(c) != "" {
+				tc, smaller = c, true
+			}
+		}
+
+		if !smaller {
+			return tc
+		}
+	}
+}
+
+// Runs check against generated test cases, and fails with a shrunk
+// counterexample on the first which check reports a problem with.
+func generated(t *testing.T, check func(testCase) string) {
+
+	n := *cases
+	if testing.Short() {
+		n /= 10
+	}
+	s := *seed
+	if s == 0 {
+		s = time.Now().UnixNano()
+	}
+	t.Logf("seed %d", s)
+	g := &generator{rng: rand.New(rand.NewSource(s))}
+
+	for i := 0; i < n; i++ {
+
+		tc := testCase{g.term(3), g.stream()}
+		if check(tc) == "" {
+			continue
+		}
+
+		tc = shrink(tc, check)
+		tree, _ := json.MarshalIndent(tc.term, "", "  ")
+		t.Fatalf("case %d of seed %d fails: %s\nIndicator:\n%s\n"+
+			"Tokens: %v", i+1, s, check(tc), tree, tc.tokens)
+
+	}
+
+}
+
+// Compiles a single term as a prepared indicator, or returns nil if the
+// term is invalid, which shrinking can produce.
+func prepared(term *Term) *Indicator {
+	ii := &Indicators{}
+	ii.Add(&Indicator{Id: "test", Term: *copyTerm(term)})
+	if err := ii.Prepare(); err != nil {
+		return nil
+	}
+	return ii.Indicators[0]
+}
+
+// Returns the sequence number of the token on which the oracle says an
+// indicator hits, or 0 if it doesn't.
+func (i *Indicator) oracleHitAt(tokens []Token) uint64 {
+	for n := range tokens {
+		if i.Oracle(tokens[:n+1]) {
+			return uint64(n + 1)
+		}
+	}
+	return 0
+}
+
+// Returns the sequence number of the first hit reported when scanning
+// tokens with a Ruleset, or 0 if there is none.
+func scanHitAt(rs *Ruleset, tokens []Token) uint64 {
+	s := rs.NewScanner()
+	at := uint64(0)
+	s.OnHit = func(h Hit) {
+		if at == 0 {
+			at = h.Sequence
+		}
+	}
+	for _, t := range tokens {
+		s.Update(t)
+	}
+	return at
+}
+
+// Returns whether scanning tokens with a Ruleset hits.
+func scanHits(rs *Ruleset, tokens []Token) bool {
+	s := rs.NewScanner()
+	for _, t := range tokens {
+		s.Update(t)
+	}
+	return len(s.GetHits()) > 0
+}
+
+// Checks that the compiled Ruleset hits on exactly the token the oracle,
+// applied to the tree as written, says it should.
+func checkScanner(tc testCase) string {
+
+	ind := prepared(tc.term)
+	if ind == nil {
+		return ""
+	}
+
+	expect := ind.oracleHitAt(tc.tokens)
+
+	rs, err := CreateRuleset(&Indicators{Indicators: []*Indicator{ind}},
+		nil)
+	if err != nil {
+		return fmt.Sprintf("compile failed: %v", err)
+	}
+	if got := scanHitAt(rs, tc.tokens); got != expect {
+		return fmt.Sprintf("scanner hit at %d, oracle hit at %d", got,
+			expect)
+	}
+	return ""
+
+}
+
+func TestScannerMatchesOracle(t *testing.T) {
+	generated(t, checkScanner)
+}
+
+func TestOracle(t *testing.T) {
+
+	a := &Term{Type: "t", Value: "a"}
+	b := &Term{Type: "t", Value: "b"}
+	ta := Token{Type: "t", Value: "a"}
+	tb := Token{Type: "t", Value: "b"}
+
+	for _, c := range []struct {
+		name   string
+		term   Term
+		tokens []Token
+		hit    bool
+	}{
+		{"and", Term{And: []*Term{a, b}}, []Token{tb, ta}, true},
+		{"and partial", Term{And: []*Term{a, b}}, []Token{ta}, false},
+		{"not at end", Term{And: []*Term{a, {Not: b}}},
+			[]Token{ta, EndToken}, true},
+		{"not seen", Term{And: []*Term{a, {Not: b}}},
+			[]Token{ta, tb, EndToken}, false},
+		{"sequence", Term{Sequence: []*Term{a, b}},
+			[]Token{ta, tb}, true},
+		{"sequence reversed", Term{Sequence: []*Term{a, b}},
+			[]Token{tb, ta}, false},
+		{"count", Term{Type: "t", Value: "a", Count: 2},
+			[]Token{ta, ta}, true},
+		{"threshold", Term{AtLeast: 2, Of: []*Term{a, b,
+			{Type: "t", Value: "c"}}}, []Token{ta, tb}, true},
+		// Found with seed 7.  t:0 satisfies every match term at
+		// once.  The OR becomes true before the first step, so is
+		// forgotten, t:0 below it included, and the NOT below it is
+		// true at 'end'.  The hit must not depend on the order the
+		// terms are applied in.
+		{"terms applied together", Term{Sequence: []*Term{
+			{Not: &Term{Sequence: []*Term{
+				{Type: "t", Value: "0"},
+				{Type: "t", Value: "0"}}}},
+			{Or: []*Term{
+				{Type: "t", Match: MatchRegex, Value: "^[01]$"},
+				{Not: &Term{Type: "t", Value: "0"}}}},
+		}}, []Token{{Type: "t", Value: "0"}, EndToken}, true},
+	} {
+		ind := &Indicator{Id: c.name, Term: c.term}
+		if got := ind.Oracle(c.tokens); got != c.hit {
+			t.Errorf("%s: expected hit=%v, got %v", c.name, c.hit,
+				got)
+		}
+	}
+
+}
@@ -0,0 +1,307 @@
+package indicators
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// A product automaton, which runs the FSMs of several indicators at once,
+// so that a token causes one transition rather than one per FSM.  Each
+// product state is a combination of member FSM states.
+type Product struct {
+
+	// FSM IDs of the member FSMs.
+	Members []int32
+
+	// Transitions between product states.  State 0 has every member in
+	// 'init'.  State names are not meaningful.
+	Table *StateTable
+
+	// Member FSM states for each product state, indexed by product
+	// state * len(Members) + member.
+	Components []int32
+
+	// Member FSM IDs in 'hit', for each product state.
+	Hits [][]int32
+}
+
+// Returns the state of a member FSM, by its position in Members, in a
+// product state.
+func (p *Product) Component(state int32, member int) int32 {
+	return p.Components[int(state)*len(p.Members)+member]
+}
+
+// Builds product automata from the Ruleset's FSMs.  FSMs which share
+// activators are grouped, up to maxMembers to a group, and each group is
+// combined into a Product, unless the Product would have more than
+// maxStates states, in which case the group's FSMs are left to run
+// separately.  FSMs with a time window, or with match terms which one
+// token might satisfy together, always run separately.  Products
+// are not saved, so this must be called again on a loaded Ruleset to use
+// them.
+func (r *Ruleset) BuildProducts(maxStates, maxMembers int) {
+
+	r.Products = nil
+	r.Grouped = make([]int32, len(r.Fsms))
+	for i := range r.Grouped {
+		r.Grouped[i] = -1
+	}
+	if maxMembers < 2 {
+		r.IndexActivators()
+		return
+	}
+
+	for _, group := range r.activatorGroups(maxMembers) {
+		if len(group) < 2 {
+			continue
+		}
+		p := r.product(group, maxStates)
+		if p == nil {
+			continue
+		}
+		for _, fsm := range group {
+			r.Grouped[fsm] = int32(len(r.Products))
+		}
+		r.Products = append(r.Products, p)
+	}
+
+	r.IndexActivators()
+
+}
+
+// Groups FSMs which share activators, splitting groups to at most
+// maxMembers FSMs.  Groups are in order of their first FSM ID, and FSMs
+// within a group are in ID order.
+func (r *Ruleset) activatorGroups(maxMembers int) [][]int32 {
+
+	// Union-find over FSM IDs.
+	parent := make([]int32, len(r.Fsms))
+	for i := range parent {
+		parent[i] = int32(i)
+	}
+	var find func(int32) int32
+	find = func(x int32) int32 {
+		for parent[x] != x {
+			parent[x] = parent[parent[x]]
+			x = parent[x]
+		}
+		return x
+	}
+
+	first := map[int32]int32{}
+	for fsm, t := range r.Fsms {
+		if !r.productable(fsm) {
+			continue
+		}
+		for _, sym := range t.Activators() {
+			other, ok := first[sym]
+			if !ok {
+				first[sym] = int32(fsm)
+				continue
+			}
+			a, b := find(int32(fsm)), find(other)
+			if a != b {
+				parent[a] = b
+			}
+		}
+	}
+
+	members := map[int32][]int32{}
+	roots := []int32{}
+	for fsm := range r.Fsms {
+		if !r.productable(fsm) {
+			continue
+		}
+		root := find(int32(fsm))
+		if _, ok := members[root]; !ok {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], int32(fsm))
+	}
+
+	groups := [][]int32{}
+	for _, root := range roots {
+		group := members[root]
+		for len(group) > maxMembers {
+			groups = append(groups, group[:maxMembers])
+			group = group[maxMembers:]
+		}
+		groups = append(groups, group)
+	}
+	return groups
+
+}
+
+// Returns true if an FSM can be a member of a product.  Products step
+// their members with one symbol at a time, so can't include FSMs with a
+// time window, or FSMs which need compound symbols because one token
+// might satisfy several of their match terms.
+func (r *Ruleset) productable(fsm int) bool {
+	if r.Windows[fsm] > 0 {
+		return false
+	}
+	terms := r.Fsms[fsm].Terms
+	for i, a := range terms {
+		ta := r.Symbols.Tokens[a]
+		for _, b := range terms[i+1:] {
+			tb := r.Symbols.Tokens[b]
+			if ta.Type != tb.Type {
+				continue
+			}
+			if ta.Match == "" && tb.Match == "" &&
+				ta.Value != tb.Value {
+				continue
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// Builds the product of a group of FSMs, exploring only states reachable
+// from all members being in 'init'.  Returns nil if there are more than
+// maxStates states.
+func (r *Ruleset) product(members []int32, maxStates int) *Product {
+
+	p := &Product{
+		Members: members,
+		Table:   &StateTable{},
+	}
+
+	// Symbols are the union of the members' symbols.
+	seen := map[int32]bool{}
+	for _, fsm := range members {
+		for _, sym := range r.Fsms[fsm].Symbols {
+			if !seen[sym] {
+				seen[sym] = true
+				p.Table.Symbols = append(p.Table.Symbols, sym)
+			}
+		}
+	}
+	sort.Slice(p.Table.Symbols, func(a, b int) bool {
+		return p.Table.Symbols[a] < p.Table.Symbols[b]
+	})
+
+	// Product states are identified by their member states.
+	ids := map[string]int32{}
+	key := func(tuple []int32) string {
+		buf := make([]byte, 4*len(tuple))
+		for i, v := range tuple {
+			binary.BigEndian.PutUint32(buf[4*i:], uint32(v))
+		}
+		return string(buf)
+	}
+	add := func(tuple []int32) int32 {
+		id := int32(len(ids))
+		ids[key(tuple)] = id
+		p.Components = append(p.Components, tuple...)
+		hits := []int32{}
+		for i, state := range tuple {
+			if state == StateHit {
+				hits = append(hits, members[i])
+			}
+		}
+		p.Hits = append(p.Hits, hits)
+		p.Table.States = append(p.Table.States, "")
+		return id
+	}
+
+	add(make([]int32, len(members)))
+
+	// Breadth-first exploration, states are numbered as found.
+	next := []int32{}
+	for state := 0; state < len(ids); state++ {
+
+		if len(ids) > maxStates {
+			return nil
+		}
+
+		for _, sym := range p.Table.Symbols {
+
+			tuple := make([]int32, len(members))
+			changed := false
+			for i, fsm := range members {
+				cur := p.Components[state*len(members)+i]
+				tuple[i] = cur
+				if to, ok := r.Fsms[fsm].Step(cur, sym); ok {
+					tuple[i] = to
+					changed = true
+				}
+			}
+
+			if !changed {
+				next = append(next, -1)
+				continue
+			}
+
+			id, ok := ids[key(tuple)]
+			if !ok {
+				id = add(tuple)
+			}
+			next = append(next, id)
+
+		}
+
+	}
+
+	p.Table.Next = next
+	return p
+
+}
+
+// Applies a symbol to the active products.  Member FSMs whose state
+// changes are recorded for explanation, and any which hit are noted.
+func (s *Scanner) stepProducts(sym int32) {
+
+	r := s.Ruleset
+
+	for _, id := range r.ProductActivators[sym] {
+		if _, ok := s.ProductState[id]; !ok && !s.doneProducts[id] {
+			s.ProductState[id] = StateInit
+			s.ScanStats.Activated++
+		}
+	}
+
+	for id, state := range s.ProductState {
+		s.ScanStats.Steps++
+		p := r.Products[id]
+		next, ok := p.Table.Step(state, sym)
+		if !ok {
+			continue
+		}
+		for i, fsm := range p.Members {
+			from := p.Component(state, i)
+			to := p.Component(next, i)
+			if from == to {
+				continue
+			}
+			s.record(fsm, from, sym, to)
+			if to == StateHit {
+				s.hits = append(s.hits, fsm)
+			}
+		}
+		s.ProductState[id] = next
+		s.dropProduct(id, next)
+	}
+
+}
+
+// Calls fn with the FSM ID and state of every activated FSM, including
+// those running as part of a product and those dropped from the active
+// set.
+func (s *Scanner) eachState(fn func(fsm, state int32)) {
+	for fsm, state := range s.State {
+		fn(fsm, state)
+	}
+	for fsm, state := range s.Done {
+		fn(fsm, state)
+	}
+	for id, state := range s.ProductState {
+		p := s.Ruleset.Products[id]
+		for i, fsm := range p.Members {
+			if c := p.Component(state, i); c != StateInit {
+				fn(fsm, c)
+			}
+		}
+	}
+}
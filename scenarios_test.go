@@ -0,0 +1,500 @@
+package indicators
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Indicators which the scenarios are run against.
+const scenarioIndicators = `{
+  "indicators": [
+    {
+      "id": "dns-then-get",
+      "sequence": [
+        { "type": "dns", "value": "malware.org" },
+        { "type": "http-get", "value": "/payload.bin" }
+      ]
+    },
+    {
+      "id": "three-steps",
+      "sequence": [
+        { "type": "step", "value": "1" },
+        { "or": [
+          { "type": "step", "value": "2a" },
+          { "type": "step", "value": "2b" }
+        ] },
+        { "and": [
+          { "type": "step", "value": "3a" },
+          { "type": "step", "value": "3b" }
+        ] }
+      ]
+    },
+    {
+      "id": "login-then-no-logout",
+      "sequence": [
+        { "type": "event", "value": "login" },
+        { "not": { "type": "event", "value": "logout" } }
+      ]
+    },
+    {
+      "id": "two-of-three",
+      "atleast": 2,
+      "of": [
+        { "type": "behaviour", "value": "a" },
+        { "type": "behaviour", "value": "b" },
+        { "type": "behaviour", "value": "c" }
+      ]
+    },
+    {
+      "id": "wp-admin",
+      "type": "url",
+      "match": "regex",
+      "value": "^https?://[^/]+/wp-admin/.*\\.php$"
+    },
+    {
+      "id": "netblock",
+      "type": "ipv4",
+      "match": "cidr",
+      "value": "198.51.100.0/24"
+    },
+    {
+      "id": "domain",
+      "type": "hostname",
+      "match": "suffix",
+      "value": "malware.org"
+    },
+    {
+      "id": "address",
+      "type": "ipv4",
+      "value": "10.0.2.15"
+    },
+    {
+      "id": "address-range",
+      "type": "ipv4",
+      "match": "range",
+      "value": "192.0.2.10-192.0.2.20"
+    },
+    {
+      "id": "ipv6-netblock",
+      "type": "ipv6",
+      "match": "cidr",
+      "value": "2001:db8:1:2::/64"
+    },
+    {
+      "id": "mapped-netblock",
+      "type": "ipv6",
+      "match": "cidr",
+      "value": "::ffff:192.0.2.0/120"
+    },
+    {
+      "id": "scan-and-exploit",
+      "within": "30s",
+      "and": [
+        { "type": "event", "value": "portscan" },
+        { "type": "event", "value": "exploit" }
+      ]
+    },
+    {
+      "id": "expired-veto",
+      "within": "30s",
+      "and": [
+        { "or": [
+          { "not": { "type": "audit", "value": "veto" } },
+          { "type": "audit", "value": "override" }
+        ] },
+        { "type": "audit", "value": "trigger" }
+      ]
+    },
+    {
+      "id": "brute-force",
+      "and": [
+        { "type": "event", "value": "login-failed", "count": 3 },
+        { "type": "event", "value": "login" }
+      ]
+    },
+    {
+      "id": "scan-burst",
+      "type": "ipv4",
+      "match": "cidr",
+      "value": "203.0.113.0/24",
+      "count": 2
+    },
+    {
+      "id": "lookup-then-fetch",
+      "within": "1m",
+      "sequence": [
+        { "type": "dns", "value": "evil.example" },
+        { "type": "http-get", "value": "/stage2" }
+      ]
+    },
+    {
+      "id": "beacon",
+      "descriptor": {
+        "description": "Beacon to C2",
+        "probability": 0.4
+      },
+      "type": "hostname",
+      "value": "c2.example"
+    },
+    {
+      "id": "beacon",
+      "descriptor": {
+        "description": "Known C2 host",
+        "probability": 0.9
+      },
+      "type": "hostname",
+      "value": "c2.example"
+    },
+    {
+      "id": "alpha",
+      "descriptor": {
+        "description": "Suspicious host",
+        "probability": 0.4
+      },
+      "type": "hostname",
+      "value": "c2.example"
+    },
+    {
+      "id": "forgotten-negation",
+      "and": [
+        { "type": "digit", "value": "start" },
+        { "sequence": [
+          { "not": { "sequence": [
+            { "type": "digit", "value": "0" },
+            { "type": "digit", "value": "0" }
+          ] } },
+          { "or": [
+            { "type": "digit", "match": "regex", "value": "^[01]$" },
+            { "not": { "type": "digit", "value": "0" } }
+          ] }
+        ] }
+      ]
+    },
+    {
+      "id": "zulu",
+      "descriptor": {
+        "description": "Threat feed host",
+        "probability": 0.9
+      },
+      "type": "hostname",
+      "value": "c2.example"
+    }
+  ]
+}`
+
+// A scenario is a token stream, and the indicator IDs expected to hit, in
+// the order GetHitsWith returns them given order and dedupe.  Tokens are
+// written type:value.  If times is set, it gives the time of each token
+// in seconds, which is fed to the Scanner by a fake clock.  If streamed is
+// set, it gives the hits expected from the Scanner's hit handler, written
+// id@sequence.  If descriptions is set, it gives the expected description
+// of each hit.
+type scenario struct {
+	name         string
+	tokens       []string
+	times        []int
+	order        HitOrder
+	dedupe       bool
+	hits         []string
+	descriptions []string
+	streamed     []string
+}
+
+var scenarios = []scenario{
+	{
+		name: "sequence in order",
+		tokens: []string{"dns:malware.org", "http-get:/payload.bin",
+			"http-get:/payload.bin"},
+		hits:     []string{"dns-then-get"},
+		streamed: []string{"dns-then-get@2"},
+	},
+	{
+		name:   "sequence out of order",
+		tokens: []string{"http-get:/payload.bin", "dns:malware.org"},
+		hits:   []string{},
+	},
+	{
+		name: "sequence step repeated after order restored",
+		tokens: []string{"http-get:/payload.bin", "dns:malware.org",
+			"http-get:/payload.bin"},
+		hits: []string{"dns-then-get"},
+	},
+	{
+		name: "nested sequence in order",
+		tokens: []string{"step:1", "step:2b", "step:3b",
+			"step:3a"},
+		hits: []string{"three-steps"},
+	},
+	{
+		name: "nested sequence completes early",
+		tokens: []string{"step:3a", "step:3b", "step:1",
+			"step:2a"},
+		hits: []string{},
+	},
+	{
+		name: "partial progress on later step is kept",
+		tokens: []string{"step:3a", "step:1", "step:2a",
+			"step:3b"},
+		hits: []string{"three-steps"},
+	},
+	{
+		name:     "sequence ending in not",
+		tokens:   []string{"event:login", "end:"},
+		hits:     []string{"login-then-no-logout"},
+		streamed: []string{"login-then-no-logout@2"},
+	},
+	{
+		name:   "sequence ending in not, vetoed",
+		tokens: []string{"event:logout", "event:login", "end:"},
+		hits:   []string{},
+	},
+	{
+		name:   "threshold reached",
+		tokens: []string{"behaviour:c", "behaviour:a"},
+		hits:   []string{"two-of-three"},
+	},
+	{
+		name:   "threshold not reached by repeats",
+		tokens: []string{"behaviour:c", "behaviour:c"},
+		hits:   []string{},
+	},
+	{
+		name:   "regex",
+		tokens: []string{"url:http://example.com/wp-admin/x/y.php"},
+		hits:   []string{"wp-admin"},
+	},
+	{
+		name:   "cidr",
+		tokens: []string{"ipv4:198.51.100.77", "ipv4:198.51.101.1"},
+		hits:   []string{"netblock"},
+	},
+	{
+		name: "range",
+		tokens: []string{"ipv4:192.0.2.9", "ipv4:192.0.2.21",
+			"ipv4:192.0.2.20"},
+		hits:     []string{"address-range"},
+		streamed: []string{"address-range@3"},
+	},
+	{
+		name: "ipv6 cidr",
+		tokens: []string{"ipv6:2001:db8:1:3::1",
+			"ipv6:2001:DB8:1:2:FFFF::1"},
+		hits:     []string{"ipv6-netblock"},
+		streamed: []string{"ipv6-netblock@2"},
+	},
+	{
+		// IPv4-mapped addresses are IPv6 addresses, and IPv4
+		// addresses aren't.
+		name: "ipv4-mapped cidr",
+		tokens: []string{"ipv4:192.0.2.7", "ipv6:::ffff:192.0.3.7",
+			"ipv6:::FFFF:C000:0207"},
+		hits:     []string{"mapped-netblock"},
+		streamed: []string{"mapped-netblock@3"},
+	},
+	{
+		name:   "domain suffix and normalisation",
+		tokens: []string{"hostname:CDN.Malware.ORG."},
+		hits:   []string{"domain"},
+	},
+	{
+		name:   "address normalisation",
+		tokens: []string{"ipv4:10.0.2.015"},
+		hits:   []string{"address"},
+	},
+	{
+		name:   "within window",
+		tokens: []string{"event:portscan", "event:exploit"},
+		times:  []int{0, 30},
+		hits:   []string{"scan-and-exploit"},
+	},
+	{
+		name:   "outside window",
+		tokens: []string{"event:portscan", "event:exploit"},
+		times:  []int{0, 31},
+		hits:   []string{},
+	},
+	{
+		name: "window restarts after expiry",
+		tokens: []string{"event:portscan", "event:exploit",
+			"event:portscan"},
+		times: []int{0, 45, 50},
+		hits:  []string{"scan-and-exploit"},
+	},
+	{
+		name:   "sequence within window",
+		tokens: []string{"dns:evil.example", "http-get:/stage2"},
+		times:  []int{100, 159},
+		hits:   []string{"lookup-then-fetch"},
+	},
+	{
+		name:   "sequence outside window",
+		tokens: []string{"dns:evil.example", "http-get:/stage2"},
+		times:  []int{100, 161},
+		hits:   []string{},
+	},
+	{
+		// Once the veto expires, replaying the evidence left hits
+		// at 'end', and the hit is reported there.
+		name: "hit when evidence is replayed",
+		tokens: []string{"audit:veto", "audit:trigger", "end:",
+			"audit:other"},
+		times:    []int{0, 10, 20, 35},
+		hits:     []string{"expired-veto"},
+		streamed: []string{"expired-veto@3"},
+	},
+	{
+		name: "count reached",
+		tokens: []string{"event:login-failed", "event:login-failed",
+			"event:login-failed", "event:login"},
+		hits: []string{"brute-force"},
+	},
+	{
+		name: "count not reached",
+		tokens: []string{"event:login-failed", "event:login",
+			"event:login-failed"},
+		hits: []string{},
+	},
+	{
+		name: "count on cidr term",
+		tokens: []string{"ipv4:203.0.113.1", "ipv4:203.0.113.200",
+			"ipv4:10.0.2.15"},
+		hits:     []string{"address", "scan-burst"},
+		streamed: []string{"scan-burst@2", "address@3"},
+	},
+	{
+		// digit:0 satisfies all four match terms at once, and the
+		// outcome mustn't depend on the order they're applied in.
+		name:     "terms applied together",
+		tokens:   []string{"digit:start", "digit:0", "end:"},
+		hits:     []string{"forgotten-negation"},
+		streamed: []string{"forgotten-negation@3"},
+	},
+	{
+		name:   "hits in load order",
+		tokens: []string{"hostname:c2.example"},
+		hits:   []string{"beacon", "beacon", "alpha", "zulu"},
+		streamed: []string{"beacon@1", "beacon@1", "alpha@1",
+			"zulu@1"},
+	},
+	{
+		name:   "hits in probability order",
+		tokens: []string{"hostname:c2.example"},
+		order:  ProbabilityOrder,
+		hits:   []string{"beacon", "zulu", "alpha", "beacon"},
+		descriptions: []string{"Known C2 host", "Threat feed host",
+			"Suspicious host", "Beacon to C2"},
+	},
+	{
+		name:   "hits de-duplicated",
+		tokens: []string{"hostname:c2.example"},
+		dedupe: true,
+		hits:   []string{"beacon", "alpha", "zulu"},
+		descriptions: []string{"Beacon to C2; Known C2 host",
+			"Suspicious host", "Threat feed host"},
+	},
+	{
+		name:   "hits de-duplicated in probability order",
+		tokens: []string{"hostname:c2.example"},
+		order:  ProbabilityOrder,
+		dedupe: true,
+		hits:   []string{"beacon", "zulu", "alpha"},
+		descriptions: []string{"Beacon to C2; Known C2 host",
+			"Threat feed host", "Suspicious host"},
+	},
+}
+
+// Parses a token written type:value.
+func parseToken(s string) Token {
+	parts := strings.SplitN(s, ":", 2)
+	return Token{Type: parts[0], Value: parts[1]}
+}
+
+// Runs a scenario against a Ruleset, returning a description of how it
+// fails, or "" if it passes.  If dropHits is set, FSMs are dropped from
+// the active set on hitting.
+func (sc *scenario) run(rs *Ruleset, dropHits bool) string {
+
+	s := rs.NewScanner()
+	s.DropHits = dropHits
+	now := time.Unix(0, 0)
+	s.Clock = func() time.Time { return now }
+
+	streamed := []string{}
+	s.OnHit = func(h Hit) {
+		streamed = append(streamed,
+			fmt.Sprintf("%s@%d", h.Indicator.Id, h.Sequence))
+	}
+
+	for i, t := range sc.tokens {
+		if sc.times != nil {
+			now = time.Unix(int64(sc.times[i]), 0)
+		}
+		s.Update(parseToken(t))
+	}
+
+	hits := []string{}
+	descriptions := []string{}
+	for _, ind := range s.GetHitsWith(&HitOptions{
+		Order:  sc.order,
+		Dedupe: sc.dedupe,
+	}) {
+		hits = append(hits, ind.Id)
+		descriptions = append(descriptions, ind.Descriptor.Description)
+	}
+
+	switch {
+	case strings.Join(hits, ",") != strings.Join(sc.hits, ","):
+		return fmt.Sprintf("got %v, expected %v", hits, sc.hits)
+	case sc.descriptions != nil && strings.Join(descriptions, ",") !=
+		strings.Join(sc.descriptions, ","):
+		return fmt.Sprintf("descriptions %q, expected %q",
+			descriptions, sc.descriptions)
+	case sc.streamed != nil && strings.Join(streamed, ",") !=
+		strings.Join(sc.streamed, ","):
+		return fmt.Sprintf("streamed %v, expected %v", streamed,
+			sc.streamed)
+	}
+	return ""
+
+}
+
+// Every scenario is run with indicators compiled separately, and combined
+// into product automata, and with and without hit FSMs dropped from the
+// active set.  All must agree.
+func TestScenarios(t *testing.T) {
+
+	ii, err := LoadIndicators([]byte(scenarioIndicators))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []struct {
+		name     string
+		product  bool
+		dropHits bool
+	}{
+		{"fsm", false, false},
+		{"fsm drop", false, true},
+		{"product", true, false},
+		{"product drop", true, true},
+	} {
+
+		opts := DefaultCompileOptions
+		opts.Product = m.product
+
+		rs, err := CreateRuleset(ii, &opts)
+		if err != nil {
+			t.Fatalf("%s: %v", m.name, err)
+		}
+
+		for _, sc := range scenarios {
+			if problem := sc.run(rs, m.dropHits); problem != "" {
+				t.Errorf("%s: %s: %s", m.name, sc.name, problem)
+			}
+		}
+
+	}
+
+}
@@ -0,0 +1,261 @@
+package indicators
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Format version of saved Rulesets.  Changed whenever the saved form
+// changes, so that caches written by older code are rejected.
+const RulesetFormatVersion uint32 = 1
+
+// Version of the indicator compiler.  Changed whenever the FSMs compiled
+// from the same indicators change, e.g. because the meaning of a term
+// changes, so that saved Rulesets compiled by older code are rejected even
+// if the saved form is the same.
+const CompilerVersion uint32 = 1
+
+// Magic number at the start of a saved Ruleset.
+var rulesetMagic = [8]byte{'I', 'N', 'D', 'F', 'S', 'M', 0, 0}
+
+var (
+	// Returned when loading something which isn't a saved Ruleset.
+	ErrNotRuleset = errors.New("not a saved ruleset")
+
+	// Returned when a saved Ruleset was compiled from different
+	// indicator source to the source supplied at load time.
+	ErrStaleRuleset = errors.New("saved ruleset is stale")
+)
+
+// Returned when a saved Ruleset was written in a different format
+// version, or compiled by a different compiler version.
+type RulesetVersionError struct {
+	Version  uint32
+	Compiler uint32
+}
+
+func (e *RulesetVersionError) Error() string {
+	return fmt.Sprintf("saved ruleset has format version %d compiler "+
+		"version %d, expected %d and %d", e.Version, e.Compiler,
+		RulesetFormatVersion, CompilerVersion)
+}
+
+// Header at the start of a saved Ruleset.
+type rulesetHeader struct {
+	Magic    [8]byte
+	Version  uint32
+	Compiler uint32
+
+	// SHA-256 hash of the indicator JSON the Ruleset was compiled from.
+	SourceHash [sha256.Size]byte
+}
+
+// The saved form of a Ruleset.  The activator index is rebuilt on load.
+type savedRuleset struct {
+	Fsms       []*StateTable
+	Indicators []*Indicator
+	Symbols    []Token
+	Skipped    []*ComplexityError
+
+	// Options the FSMs were compiled with.
+	Options CompileOptions
+
+	// Token types which had normalisers when the Ruleset was compiled.
+	// Exact match values were normalised with them, so a Ruleset is
+	// stale if the types are different when it is loaded.
+	Normalised []string
+}
+
+// Saves a Ruleset in binary form.  source is the indicator JSON the
+// Ruleset was compiled from; a hash of it is stored so that LoadRuleset
+// can detect a stale Ruleset.
+func (r *Ruleset) Save(w io.Writer, source []byte) error {
+
+	hdr := rulesetHeader{
+		Magic:      rulesetMagic,
+		Version:    RulesetFormatVersion,
+		Compiler:   CompilerVersion,
+		SourceHash: sha256.Sum256(source),
+	}
+
+	saved := savedRuleset{
+		Fsms:       r.Fsms,
+		Indicators: r.Indicators,
+		Symbols:    r.Symbols.Tokens,
+		Skipped:    r.Skipped,
+		Options:    r.Options,
+		Normalised: normalisedTypes(r.normalisers),
+	}
+
+	bw := bufio.NewWriter(w)
+	err := binary.Write(bw, binary.BigEndian, &hdr)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(bw).Encode(&saved)
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+
+}
+
+// Loads a Ruleset saved by Save.  source is the indicator JSON the Ruleset
+// is expected to have been compiled from.  ErrStaleRuleset is returned if
+// the Ruleset was compiled from something else, or with normalisers for a
+// different set of token types, in which case the caller should
+// recompile.  A normaliser replaced by another for the same type can't be
+// detected.
+func LoadRuleset(rd io.Reader, source []byte) (*Ruleset, error) {
+
+	br := bufio.NewReader(rd)
+
+	var hdr rulesetHeader
+	err := binary.Read(br, binary.BigEndian, &hdr)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrNotRuleset
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Magic != rulesetMagic {
+		return nil, ErrNotRuleset
+	}
+	if hdr.Version != RulesetFormatVersion ||
+		hdr.Compiler != CompilerVersion {
+		return nil, &RulesetVersionError{hdr.Version, hdr.Compiler}
+	}
+	if hdr.SourceHash != sha256.Sum256(source) {
+		return nil, ErrStaleRuleset
+	}
+
+	var saved savedRuleset
+	err = gob.NewDecoder(br).Decode(&saved)
+	if err != nil {
+		return nil, err
+	}
+	if len(saved.Fsms) != len(saved.Indicators) {
+		return nil, ErrNotRuleset
+	}
+	types := normalisedTypes(registeredNormalisers())
+	if strings.Join(saved.Normalised, ",") != strings.Join(types, ",") {
+		return nil, ErrStaleRuleset
+	}
+
+	r := Ruleset{
+		Fsms:       saved.Fsms,
+		Indicators: saved.Indicators,
+		Symbols:    NewSymbolTable(),
+		Skipped:    saved.Skipped,
+		Options:    saved.Options,
+	}
+	for _, token := range saved.Symbols {
+		r.Symbols.Intern(token)
+	}
+
+	// Indicators are saved as written, so make the simplified copies
+	// again, for navigators which match the FSMs.
+	for _, ind := range r.Indicators {
+		ind.Simplify()
+	}
+
+	// Check tables are consistent, so that scanning can't index out
+	// of range.
+	for _, t := range r.Fsms {
+		if !t.valid(len(r.Symbols.Tokens)) {
+			return nil, ErrNotRuleset
+		}
+	}
+
+	err = r.index()
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+
+}
+
+// Saves a Ruleset to a file.  The file is written to a temporary name and
+// renamed into place, so a concurrent reader never sees a partial file.
+func (r *Ruleset) SaveToFile(path string, source []byte) error {
+
+	var buf bytes.Buffer
+	err := r.Save(&buf, source)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+
+}
+
+// Loads a Ruleset from a file.
+func LoadRulesetFromFile(path string, source []byte) (*Ruleset, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return LoadRuleset(f, source)
+
+}
+
+// Returns a Ruleset for the indicator file at path, using a saved Ruleset
+// at cache if it is up to date and was compiled with the same options.
+// Otherwise, indicators are compiled with opts and the result is saved to
+// cache for next time.  opts may be nil, meaning no limits.  Product
+// automata aren't saved, so are built afresh if opts asks for them.
+func LoadRulesetCached(path, cache string, opts *CompileOptions) (*Ruleset, error) {
+
+	if opts == nil {
+		opts = &CompileOptions{}
+	}
+
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := LoadRulesetFromFile(cache, source)
+	if err == nil && r.Options.fsmOptions() == opts.fsmOptions() {
+		if opts.Product {
+			r.buildProducts(opts)
+		}
+		return r, nil
+	}
+
+	ii, err := LoadIndicators(source)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err = CreateRuleset(ii, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.SaveToFile(cache, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+
+}
@@ -0,0 +1,176 @@
+package indicators
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadFile(t *testing.T, path string) (*Indicators, []byte) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ii, err := LoadIndicators(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ii, source
+}
+
+func TestSaveLoad(t *testing.T) {
+
+	ii, source := loadFile(t, "ind3.json")
+	rs, err := CreateRuleset(ii, &DefaultCompileOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := rs.Save(&buf, source); err != nil {
+		t.Fatal(err)
+	}
+	saved := buf.Bytes()
+
+	loaded, err := LoadRuleset(bytes.NewReader(saved), source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := []Token{
+		{Type: "tcp", Value: "80"},
+		{Type: "url", Value: "http://www.example.com/malware.dat"},
+		EndToken,
+	}
+	if scanHits(rs, tokens) != scanHits(loaded, tokens) {
+		t.Error("loaded ruleset scans differently")
+	}
+
+	_, err = LoadRuleset(bytes.NewReader(saved), []byte("{}"))
+	if err != ErrStaleRuleset {
+		t.Errorf("expected stale ruleset, got %v", err)
+	}
+
+}
+
+// Saved Rulesets written in another format, or by another compiler, are
+// rejected.
+func TestRulesetVersionMismatch(t *testing.T) {
+
+	ii, source := loadFile(t, "ind3.json")
+	rs, err := CreateRuleset(ii, &DefaultCompileOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := rs.Save(&buf, source); err != nil {
+		t.Fatal(err)
+	}
+	saved := buf.Bytes()
+
+	// The header has the format and compiler versions after the
+	// magic number.
+	for _, c := range []struct {
+		version, compiler uint32
+	}{
+		{RulesetFormatVersion + 1, CompilerVersion},
+		{RulesetFormatVersion, CompilerVersion - 1},
+		{RulesetFormatVersion, CompilerVersion + 1},
+	} {
+		other := append([]byte{}, saved...)
+		binary.BigEndian.PutUint32(other[8:], c.version)
+		binary.BigEndian.PutUint32(other[12:], c.compiler)
+
+		_, err = LoadRuleset(bytes.NewReader(other), source)
+		var verr *RulesetVersionError
+		if !errors.As(err, &verr) || verr.Version != c.version ||
+			verr.Compiler != c.compiler {
+			t.Errorf("version %d compiler %d: expected a version "+
+				"error, got %v", c.version, c.compiler, err)
+		}
+	}
+
+}
+
+// A Ruleset keeps the normalisers it was created with, and a saved
+// Ruleset is stale if the normalised types change.
+func TestRulesetNormalisers(t *testing.T) {
+
+	ii, err := LoadIndicators([]byte(`{"indicators": [
+		{"id": "mail", "type": "email", "value": "bad@example.com"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := CreateRuleset(ii, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := rs.Save(&buf, []byte("source")); err != nil {
+		t.Fatal(err)
+	}
+
+	RegisterNormaliser("email", nil)
+	defer RegisterNormaliser("email", strings.ToLower)
+
+	mixed := []Token{{Type: "email", Value: "Bad@Example.COM"}}
+	if !scanHits(rs, mixed) {
+		t.Error("ruleset lost its normaliser")
+	}
+
+	_, err = LoadRuleset(&buf, []byte("source"))
+	if err != ErrStaleRuleset {
+		t.Errorf("expected stale ruleset, got %v", err)
+	}
+
+}
+
+// A cached Ruleset is only used if it was compiled with the same options,
+// and products are built for it if asked for.
+func TestLoadRulesetCached(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "indicators")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "ind3.rules")
+
+	opts := DefaultCompileOptions
+	opts.Product = false
+	if _, err := LoadRulesetCached("ind3.json", cache, &opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Saved Rulesets have no minimisation stats, so they show whether
+	// the cache was used.
+	opts.Product = true
+	rs, err := LoadRulesetCached("ind3.json", cache, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Stats != (MinimiseStats{}) {
+		t.Error("cache not used")
+	}
+	if len(rs.Grouped) != len(rs.Fsms) {
+		t.Error("products not built for cached ruleset")
+	}
+
+	opts.MaxStates /= 2
+	rs, err = LoadRulesetCached("ind3.json", cache, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Stats == (MinimiseStats{}) {
+		t.Error("cache used despite different options")
+	}
+	if rs.Options != opts {
+		t.Error("ruleset doesn't record its options")
+	}
+
+}
@@ -0,0 +1,256 @@
+package indicators
+
+import (
+	"encoding/json"
+)
+
+// What simplification has worked out about a term.
+type termInfo struct {
+
+	// The term can never be true.
+	never bool
+
+	// The term is always true by the end of scanning.
+	always bool
+}
+
+// Where a term being simplified sits in the tree.
+type simplifyContext struct {
+
+	// Below a sequence, terms can be forgotten, so a term's truth
+	// depends on when it becomes true, not just whether it does.
+	sequence bool
+}
+
+// Returns a key which is equal for identical term trees.
+func (l *Term) key() string {
+	data, _ := json.Marshal(l)
+	return string(data)
+}
+
+// Makes a simplified copy of an indicator's term tree, see Term.Simplify,
+// which is compiled in place of the tree as written.  Term is left as
+// it is, so hits and explanations show the indicator as written.  Prepare
+// calls this.
+func (i *Indicator) Simplify() {
+
+	t, _ := i.Term.simplify(simplifyContext{})
+
+	// A window needs an AND or sequence at the top.
+	if i.Within != "" && !t.IsAnd() && !t.IsSequence() {
+		t = &Term{And: []*Term{t}}
+	}
+	t.Within = i.Within
+
+	i.compiled = t
+
+}
+
+// Returns the term tree which is compiled: the simplified copy if
+// Simplify has been called, otherwise the tree as written.
+func (i *Indicator) root() *Term {
+	if i.compiled != nil {
+		return i.compiled
+	}
+	return &i.Term
+}
+
+// Returns a simplified copy of a term tree, which hits on the same token
+// as the original.  Nested ANDs and ORs are flattened, duplicate AND and
+// OR children are removed outside sequences, single-child terms are
+// collapsed, thresholds of 1 or of all their terms become OR or AND, and
+// branches which can never be true are dropped from ORs and thresholds.
+// Double negation is kept: NOT NOT X is only true at the end of scanning,
+// where X is true as soon as it matches, so removing it would move hits.
+func (l *Term) Simplify() *Term {
+	t, _ := l.simplify(simplifyContext{})
+	return t
+}
+
+func (l *Term) simplify(ctx simplifyContext) (*Term, termInfo) {
+
+	switch {
+	case l.IsAnd():
+		return simplifyAnd(l.And, ctx)
+	case l.IsOr():
+		return simplifyOr(l.Or, ctx)
+	case l.IsNot():
+		return l.simplifyNot(ctx)
+	case l.IsThreshold():
+		return l.simplifyThreshold(ctx)
+	case l.IsSequence():
+		return l.simplifySequence(ctx)
+	}
+
+	c := *l
+	c.Within = ""
+	return &c, termInfo{}
+
+}
+
+func (l *Term) simplifyNot(ctx simplifyContext) (*Term, termInfo) {
+
+	child, info := l.Not.simplify(ctx)
+	return &Term{Not: child}, termInfo{never: info.always,
+		always: info.never}
+
+}
+
+// Removes duplicate terms, keeping the first of each, and returns the keys
+// of the terms.  Below a sequence, duplicates are kept: identical match
+// terms are applied in tree order, and when a sequence forgets a step,
+// which of them end up forgotten depends on that order.
+func dedupe(terms []*Term, ctx simplifyContext) ([]*Term, map[string]bool) {
+	seen := map[string]bool{}
+	out := []*Term{}
+	for _, t := range terms {
+		k := t.key()
+		if seen[k] && !ctx.sequence {
+			continue
+		}
+		seen[k] = true
+		out = append(out, t)
+	}
+	return out, seen
+}
+
+// Returns true if a set of sibling keys contains a term and its negation.
+func negated(terms []*Term, keys map[string]bool) bool {
+	for _, t := range terms {
+		if t.Not != nil && keys[t.Not.key()] {
+			return true
+		}
+	}
+	return false
+}
+
+func simplifyAnd(terms []*Term, ctx simplifyContext) (*Term, termInfo) {
+
+	children := []*Term{}
+	info := termInfo{always: true}
+	for _, v := range terms {
+		t, ci := v.simplify(ctx)
+		info.never = info.never || ci.never
+		info.always = info.always && ci.always
+		if t.IsAnd() {
+			children = append(children, t.And...)
+		} else {
+			children = append(children, t)
+		}
+	}
+	children, keys := dedupe(children, ctx)
+
+	// X AND NOT X: NOT X can only become true at the end, if X isn't
+	// true, so this is never true.
+	if negated(children, keys) {
+		info.never = true
+		info.always = false
+	}
+
+	if len(children) == 1 {
+		return children[0], info
+	}
+	return &Term{And: children}, info
+
+}
+
+func simplifyOr(terms []*Term, ctx simplifyContext) (*Term, termInfo) {
+
+	// Children which can never be true make no difference, but if
+	// they all are, one is kept so that the tree still describes
+	// something.
+	children := []*Term{}
+	var fallback *Term
+	info := termInfo{never: true}
+	for _, v := range terms {
+		t, ci := v.simplify(ctx)
+		info.always = info.always || ci.always
+		if ci.never {
+			if fallback == nil {
+				fallback = t
+			}
+			continue
+		}
+		info.never = false
+		if t.IsOr() {
+			children = append(children, t.Or...)
+		} else {
+			children = append(children, t)
+		}
+	}
+	if len(children) == 0 {
+		children = append(children, fallback)
+	}
+	children, keys := dedupe(children, ctx)
+
+	// X OR NOT X: one of them is true by the end.
+	if negated(children, keys) {
+		info.always = true
+	}
+
+	if len(children) == 1 {
+		return children[0], info
+	}
+	return &Term{Or: children}, info
+
+}
+
+func (l *Term) simplifyThreshold(ctx simplifyContext) (*Term, termInfo) {
+
+	if l.AtLeast == 1 {
+		return simplifyOr(l.Of, ctx)
+	}
+	if l.AtLeast == len(l.Of) {
+		return simplifyAnd(l.Of, ctx)
+	}
+
+	children := []*Term{}
+	possible := []*Term{}
+	info := termInfo{}
+	always := 0
+	for _, v := range l.Of {
+		t, ci := v.simplify(ctx)
+		children = append(children, t)
+		if ci.always {
+			always++
+		}
+		if !ci.never {
+			possible = append(possible, t)
+		}
+	}
+	info.always = always >= l.AtLeast
+
+	// Children which can never be true can be dropped, unless that
+	// leaves too few to reach the threshold, in which case the
+	// threshold can never be reached.
+	if len(possible) < l.AtLeast {
+		info.never = true
+		return &Term{Of: children, AtLeast: l.AtLeast}, info
+	}
+	if len(possible) < len(children) {
+		t := &Term{Of: possible, AtLeast: l.AtLeast}
+		return t.simplifyThreshold(ctx)
+	}
+
+	return &Term{Of: children, AtLeast: l.AtLeast}, info
+
+}
+
+func (l *Term) simplifySequence(ctx simplifyContext) (*Term, termInfo) {
+
+	ctx.sequence = true
+
+	steps := []*Term{}
+	info := termInfo{}
+	for _, v := range l.Sequence {
+		t, si := v.simplify(ctx)
+		steps = append(steps, t)
+		info.never = info.never || si.never
+	}
+
+	if len(steps) == 1 {
+		return steps[0], info
+	}
+	return &Term{Sequence: steps}, info
+
+}
@@ -0,0 +1,123 @@
+package indicators
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Checks that the simplified tree hits on exactly the token the tree as
+// written does.
+func checkSimplified(tc testCase) string {
+
+	ind := prepared(tc.term)
+	if ind == nil {
+		return ""
+	}
+
+	simplified := &Indicator{Id: "test", Term: *ind.root()}
+	expect := ind.oracleHitAt(tc.tokens)
+	if got := simplified.oracleHitAt(tc.tokens); got != expect {
+		return fmt.Sprintf("simplified hit at %d, written hit at %d",
+			got, expect)
+	}
+	return ""
+
+}
+
+func TestSimplifyEquivalent(t *testing.T) {
+	generated(t, checkSimplified)
+}
+
+func TestSimplify(t *testing.T) {
+
+	a := &Term{Type: "t", Value: "a"}
+	b := &Term{Type: "t", Value: "b"}
+	c := &Term{Type: "t", Value: "c"}
+
+	for _, tc := range []struct {
+		name         string
+		term, expect *Term
+	}{
+		{"flatten", &Term{Or: []*Term{a, {Or: []*Term{b, c}}}},
+			&Term{Or: []*Term{a, b, c}}},
+		{"double not kept", &Term{And: []*Term{a, {Not: &Term{Not: b}}}},
+			&Term{And: []*Term{a, {Not: &Term{Not: b}}}}},
+		{"duplicates", &Term{And: []*Term{a, b, a}},
+			&Term{And: []*Term{a, b}}},
+		{"singleton", &Term{And: []*Term{{Or: []*Term{a}}}}, a},
+		{"threshold of 1", &Term{AtLeast: 1, Of: []*Term{a, b}},
+			&Term{Or: []*Term{a, b}}},
+		{"threshold of all", &Term{AtLeast: 2, Of: []*Term{a, b}},
+			&Term{And: []*Term{a, b}}},
+		{"never", &Term{Or: []*Term{a, {And: []*Term{b,
+			{Not: b}}}}}, a},
+		{"sequence duplicates",
+			&Term{Sequence: []*Term{a, a, b}},
+			&Term{Sequence: []*Term{a, a, b}}},
+	} {
+		if got := tc.term.Simplify(); got.key() != tc.expect.key() {
+			t.Errorf("%s: expected %s, got %s", tc.name,
+				tc.expect.key(), got.key())
+		}
+	}
+
+}
+
+// Indicators are compiled from a simplified copy, but hits, saved Rulesets
+// and explanations show the tree as written.
+func TestSimplifyKeepsTerm(t *testing.T) {
+
+	source := []byte(`{"indicators": [
+		{"id": "nested", "or": [
+			{"type": "t", "value": "a"},
+			{"or": [{"type": "t", "value": "b"}]}
+		]}
+	]}`)
+	ii, err := LoadIndicators(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := ii.Indicators[0].Term.key()
+	if ii.Indicators[0].root().key() == written {
+		t.Fatal("tree wasn't simplified")
+	}
+
+	rs, err := CreateRuleset(ii, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := rs.Save(&buf, source); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadRuleset(&buf, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []*Ruleset{rs, loaded} {
+
+		s := r.NewScanner()
+		s.Explain = true
+		s.Update(Token{Type: "t", Value: "b"})
+
+		hits := s.GetHits()
+		if len(hits) != 1 || hits[0].Term.key() != written {
+			t.Fatalf("hit doesn't show the tree as written")
+		}
+
+		// The nested OR is explained, with the term which was
+		// true.
+		e := s.ExplainHits()[0]
+		tree := e.Format()
+		if strings.Count(tree, ": OR") != 2 ||
+			!strings.Contains(tree, "t:b  [true at #1]") {
+			t.Errorf("explanation doesn't show the tree as "+
+				"written:\n%s", tree)
+		}
+
+	}
+
+}
@@ -0,0 +1,262 @@
+package indicators
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Interns tokens as small integer symbol IDs.  A single SymbolTable is
+// shared by all FSMs in a Ruleset, so a token is looked up once per
+// update, rather than once per FSM.
+type SymbolTable struct {
+
+	// Maps token to symbol ID.
+	Ids map[Token]int32
+
+	// Tokens, indexed by symbol ID.
+	Tokens []Token
+}
+
+// Creates an empty SymbolTable.
+func NewSymbolTable() *SymbolTable {
+	return &SymbolTable{Ids: map[Token]int32{}}
+}
+
+// Returns the symbol ID for a token, allocating a new ID if the token
+// hasn't been seen before.
+func (st *SymbolTable) Intern(token Token) int32 {
+	if id, ok := st.Ids[token]; ok {
+		return id
+	}
+	id := int32(len(st.Tokens))
+	st.Ids[token] = id
+	st.Tokens = append(st.Tokens, token)
+	return id
+}
+
+// Returns the symbol ID for a token.  Returns false if the token is not
+// in the table, in which case it cannot cause any FSM transition.
+func (st *SymbolTable) Lookup(token Token) (int32, bool) {
+	id, ok := st.Ids[token]
+	return id, ok
+}
+
+// State IDs which are the same in every StateTable.
+const (
+	StateInit int32 = 0
+	StateHit  int32 = 1
+	StateFail int32 = 2
+)
+
+// An FSM in its compiled form.  States are interned as small integers,
+// and tokens as symbol IDs from the Ruleset's SymbolTable, so that a
+// transition is a search of the FSM's symbols for its column, then an
+// array lookup.
+type StateTable struct {
+
+	// State names, indexed by state ID.  The first three are always
+	// 'init', 'hit' and 'fail'.
+	States []string
+
+	// The symbols which cause transitions in this FSM, in ascending
+	// order.  The position of a symbol in this array is its column in
+	// the transition table.
+	Symbols []int32
+
+	// Transition table, indexed by state ID * len(Symbols) + column.
+	// Contains the next state ID, or -1 for no transition.
+	Next []int32
+
+	// The symbols of all the FSM's match terms, in ascending order.
+	// Where a token satisfies several of them, the FSM takes the
+	// transition for their compound symbol instead.
+	Terms []int32
+}
+
+// Returns the number of cells Tabulate would allocate for an FSM.
+func (fsm *Fsm) TableSize() int {
+	states := map[string]bool{"init": true, "hit": true, "fail": true}
+	tokens := map[Token]bool{}
+	for _, v := range fsm.Transitions {
+		states[v.Current] = true
+		states[v.Next] = true
+		for _, token := range v.Token {
+			tokens[token] = true
+		}
+	}
+	return len(states) * len(tokens)
+}
+
+// Converts an Fsm to a StateTable, interning tokens in st.
+func (fsm *Fsm) Tabulate(st *SymbolTable) *StateTable {
+
+	t := &StateTable{
+		States: []string{"init", "hit", "fail"},
+	}
+
+	// Allocate state IDs.  Sorting state names keeps IDs stable.
+	states := map[string]int32{"init": StateInit, "hit": StateHit,
+		"fail": StateFail}
+	names := []string{}
+	for _, v := range fsm.Transitions {
+		for _, name := range []string{v.Current, v.Next} {
+			if _, ok := states[name]; !ok {
+				states[name] = -1
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		states[name] = int32(len(t.States))
+		t.States = append(t.States, name)
+	}
+
+	// Intern symbols, and work out columns.
+	columns := map[int32]int{}
+	for _, v := range fsm.Transitions {
+		for _, token := range v.Token {
+			sym := st.Intern(token)
+			if _, ok := columns[sym]; !ok {
+				columns[sym] = 0
+				t.Symbols = append(t.Symbols, sym)
+			}
+		}
+	}
+	sort.Slice(t.Symbols, func(a, b int) bool {
+		return t.Symbols[a] < t.Symbols[b]
+	})
+	for col, sym := range t.Symbols {
+		columns[sym] = col
+	}
+
+	// Intern the match terms' tokens, including any which cause no
+	// transitions, so that a Scanner knows which of a token's terms
+	// belong to this FSM.
+	for _, token := range fsm.Terms {
+		t.Terms = append(t.Terms, st.Intern(token))
+	}
+	sort.Slice(t.Terms, func(a, b int) bool {
+		return t.Terms[a] < t.Terms[b]
+	})
+
+	// Fill in the transition table.
+	t.Next = make([]int32, len(t.States)*len(t.Symbols))
+	for i := range t.Next {
+		t.Next[i] = -1
+	}
+	for _, v := range fsm.Transitions {
+		cur := int(states[v.Current])
+		for _, token := range v.Token {
+			col := columns[st.Ids[token]]
+			t.Next[cur*len(t.Symbols)+col] = states[v.Next]
+		}
+	}
+
+	return t
+
+}
+
+// Returns the column for a symbol, or -1 if the symbol causes no
+// transitions in this FSM.  This is a binary search of the FSM's own
+// symbols, which most FSMs have only a few of.  Indexing columns by
+// symbol ID instead would need a row of every symbol in the Ruleset for
+// each FSM, which for 100,000 indicators is some 10^10 cells.  See
+// BenchmarkScanStateTable.
+func (t *StateTable) Column(sym int32) int {
+	col := sort.Search(len(t.Symbols), func(i int) bool {
+		return t.Symbols[i] >= sym
+	})
+	if col < len(t.Symbols) && t.Symbols[col] == sym {
+		return col
+	}
+	return -1
+}
+
+// Returns true if sym is the symbol of one of the FSM's match terms.
+func (t *StateTable) HasTerm(sym int32) bool {
+	i := sort.Search(len(t.Terms), func(i int) bool {
+		return t.Terms[i] >= sym
+	})
+	return i < len(t.Terms) && t.Terms[i] == sym
+}
+
+// Returns the state reached from state on observing symbol sym.  Returns
+// false if there is no such transition.
+func (t *StateTable) Step(state, sym int32) (int32, bool) {
+	col := t.Column(sym)
+	if col < 0 {
+		return state, false
+	}
+	next := t.Next[int(state)*len(t.Symbols)+col]
+	if next < 0 {
+		return state, false
+	}
+	return next, true
+}
+
+// Returns true if no symbol takes the FSM out of a state.
+func (t *StateTable) Final(state int32) bool {
+	row := t.Next[int(state)*len(t.Symbols) : int(state+1)*len(t.Symbols)]
+	for _, next := range row {
+		if next >= 0 && next != state {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the symbols which take the FSM out of the 'init' state.
+func (t *StateTable) Activators() []int32 {
+	activs := []int32{}
+	for col, sym := range t.Symbols {
+		if t.Next[int(StateInit)*len(t.Symbols)+col] >= 0 {
+			activs = append(activs, sym)
+		}
+	}
+	return activs
+}
+
+// Returns true if the table is well-formed, with symbols less than
+// nsymbols.  Used to check tables which have been loaded from a file.
+func (t *StateTable) valid(nsymbols int) bool {
+	if len(t.States) < 3 || len(t.Next) != len(t.States)*len(t.Symbols) {
+		return false
+	}
+	for i, sym := range t.Symbols {
+		if sym < 0 || int(sym) >= nsymbols {
+			return false
+		}
+		if i > 0 && t.Symbols[i-1] >= sym {
+			return false
+		}
+	}
+	for _, next := range t.Next {
+		if next < -1 || int(next) >= len(t.States) {
+			return false
+		}
+	}
+	for i, sym := range t.Terms {
+		if sym < 0 || int(sym) >= nsymbols {
+			return false
+		}
+		if i > 0 && t.Terms[i-1] >= sym {
+			return false
+		}
+	}
+	return true
+}
+
+// Dumps a StateTable, using st to name symbols.
+func (t *StateTable) Dump(st *SymbolTable) {
+	for state := range t.States {
+		for col, sym := range t.Symbols {
+			next := t.Next[state*len(t.Symbols)+col]
+			if next < 0 {
+				continue
+			}
+			fmt.Printf("%s -> %s -> %s\n", t.States[state],
+				st.Tokens[sym], t.States[next])
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package indicators
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Maximum depth of a term tree.  Deeper trees are rejected, so that
+// recursion over untrusted trees is bounded.
+const MaxTermDepth = 64
+
+// A problem which stops an indicator from being used.
+type Problem struct {
+
+	// ID of the indicator, empty if it has none.
+	Id string
+
+	// Path to the offending part of the indicator file, in JSON terms
+	// e.g. indicators[3].and[1].not
+	Path string
+
+	// Description of the problem.
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Id == "" {
+		return p.Path + ": " + p.Message
+	}
+	return p.Path + " (indicator " + p.Id + "): " + p.Message
+}
+
+// Returned when indicators fail validation, lists every problem found.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0].String()
+	}
+	return fmt.Sprintf("%s (and %d more problems)", e.Problems[0],
+		len(e.Problems)-1)
+}
+
+// Checks indicators, returning all problems found.  Every term must be
+// exactly one of type/value, and, or, not, threshold or sequence, and
+// match flavours, counts, thresholds and time windows must make sense.
+// Indicators with problems can't be prepared or compiled.
+func (ii *Indicators) Validate() []Problem {
+	problems := []Problem{}
+	for i, ind := range ii.Indicators {
+		problems = append(problems,
+			ind.validate("indicators["+strconv.Itoa(i)+"]")...)
+	}
+	return problems
+}
+
+// Removes indicators which fail validation, returning their problems.
+func (ii *Indicators) DropInvalid() []Problem {
+	problems := []Problem{}
+	valid := []*Indicator{}
+	for i, ind := range ii.Indicators {
+		p := ind.validate("indicators[" + strconv.Itoa(i) + "]")
+		if len(p) > 0 {
+			problems = append(problems, p...)
+			continue
+		}
+		valid = append(valid, ind)
+	}
+	ii.Indicators = valid
+	return problems
+}
+
+// Checks an indicator, returning the first problem found, or nil.
+func (i *Indicator) Check() error {
+	problems := i.validate("indicator")
+	if len(problems) > 0 {
+		return errors.New(problems[0].Message)
+	}
+	return nil
+}
+
+// Returns all problems with an indicator, which is found at path.
+func (i *Indicator) validate(path string) []Problem {
+
+	if i == nil {
+		return []Problem{{Path: path, Message: "missing indicator"}}
+	}
+
+	problems := []Problem{}
+	report := func(path, message string) {
+		problems = append(problems, Problem{
+			Id:      i.Id,
+			Path:    path,
+			Message: message,
+		})
+	}
+
+	i.Term.validate(path, 0, report)
+
+	if i.Within != "" {
+		if _, err := i.Window(); err != nil {
+			report(path+".within", err.Error())
+		}
+	}
+
+	// Occurrence counts aren't timed, so can't be expired with the
+	// rest of the evidence in a window.  The tree is only walked once
+	// it is known to be well-formed.
+	if i.Within != "" && len(problems) == 0 && i.hasCount() {
+		report(path+".within", "within can't be used with count, as "+
+			"occurrences are counted for the whole scan")
+	}
+
+	return problems
+
+}
+
+// Returns true if any match term in an indicator has a count.
+func (i *Indicator) hasCount() bool {
+	found := false
+	i.Walk(func(l *Term, _ interface{}, _ *Term) error {
+		found = found || l.Count > 1
+		return nil
+	})
+	return found
+}
+
+// Checks a term, which is found at path, and everything below it.
+func (l *Term) validate(path string, depth int, report func(string, string)) {
+
+	if l == nil {
+		report(path, "missing term")
+		return
+	}
+	if depth >= MaxTermDepth {
+		report(path, fmt.Sprintf("term tree deeper than %d",
+			MaxTermDepth))
+		return
+	}
+
+	kinds := 0
+	for _, is := range []bool{l.IsMatchTerm(), l.IsAnd(), l.IsOr(),
+		l.IsNot(), l.IsThreshold(), l.IsSequence()} {
+		if is {
+			kinds++
+		}
+	}
+	switch {
+	case kinds > 1:
+		report(path, "term mixes type/value, and, or, not, of and "+
+			"sequence")
+	case l.Type != "" && l.Value == "":
+		report(path, "type without value")
+	case l.Value != "" && l.Type == "":
+		report(path, "value without type")
+	case kinds == 0:
+		report(path, "empty term")
+	}
+
+	if l.Match != "" && !l.IsMatchTerm() {
+		report(path+".match", "match is only supported on type/value "+
+			"terms")
+	}
+	if l.Count < 0 || (l.Count > 0 && !l.IsMatchTerm()) {
+		report(path+".count", "count is only supported on type/value "+
+			"terms, and must be positive")
+	}
+	if l.AtLeast != 0 || l.IsThreshold() {
+		if l.AtLeast < 1 || l.AtLeast > len(l.Of) {
+			report(path+".atleast", fmt.Sprintf("atleast %d is "+
+				"out of range for %d terms", l.AtLeast,
+				len(l.Of)))
+		}
+	}
+	if l.Within != "" && depth > 0 {
+		report(path+".within", "within is only supported on the "+
+			"top-level term, as an indicator's FSM has a single "+
+			"clock")
+	}
+
+	// Compile a copy, so that validation leaves the term alone.
+	if kinds == 1 && l.IsMatchTerm() {
+		c := Term{Type: l.Type, Value: l.Value, Match: l.Match}
+		if err := c.compileMatch(); err != nil {
+			report(path, err.Error())
+		}
+	}
+
+	if l.Not != nil {
+		l.Not.validate(path+".not", depth+1, report)
+	}
+	children := []struct {
+		name  string
+		terms []*Term
+	}{
+		{"and", l.And}, {"or", l.Or}, {"of", l.Of},
+		{"sequence", l.Sequence},
+	}
+	for _, c := range children {
+		if c.terms != nil && len(c.terms) == 0 {
+			report(path+"."+c.name, "empty "+c.name)
+		}
+		for i, v := range c.terms {
+			v.validate(path+"."+c.name+"["+strconv.Itoa(i)+"]",
+				depth+1, report)
+		}
+	}
+
+}
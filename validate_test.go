@@ -0,0 +1,142 @@
+package indicators
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCountWithinRejected(t *testing.T) {
+
+	_, err := LoadIndicators([]byte(`{
+  "indicators": [
+    {
+      "id": "burst",
+      "within": "10s",
+      "and": [
+        { "type": "event", "value": "login-failed", "count": 3 },
+        { "type": "event", "value": "login" }
+      ]
+    }
+  ]
+}`))
+	if err == nil || !strings.Contains(err.Error(), "count") {
+		t.Errorf("expected count under within to be rejected, got %v",
+			err)
+	}
+
+}
+
+// Problems give the path to the offending part of the file, and the ID of
+// the indicator it's in.
+func TestValidateProblems(t *testing.T) {
+
+	for _, c := range []struct {
+		name, indicators string
+		expect           []string
+	}{
+		{"path", `
+			{"id": "a", "type": "t", "value": "a"},
+			{"id": "b", "type": "t", "value": "b"},
+			{"id": "c", "type": "t", "value": "c"},
+			{"id": "d", "and": [{"type": "t", "value": "d"}, {}]}`,
+			[]string{"indicators[3].and[1] (indicator d): " +
+				"empty term"}},
+		{"several", `
+			{"id": "a", "not": {"type": "t"}},
+			{"id": "b", "atleast": 3, "of": [
+				{"type": "t", "value": "a"},
+				{"value": "b"}
+			]}`,
+			[]string{
+				"indicators[0].not (indicator a): type " +
+					"without value",
+				"indicators[1].atleast (indicator b): " +
+					"atleast 3 is out of range for 2 terms",
+				"indicators[1].of[1] (indicator b): value " +
+					"without type",
+			}},
+		{"nested within", `
+			{"id": "a", "or": [
+				{"within": "1s", "type": "t", "value": "a"}
+			]}`,
+			[]string{"indicators[0].or[0].within (indicator a): " +
+				"within is only supported on the top-level " +
+				"term, as an indicator's FSM has a single " +
+				"clock"}},
+		{"no id", `{"type": "t", "value": "a"}`, []string{}},
+	} {
+		ii := &Indicators{}
+		err := json.Unmarshal([]byte(`{"indicators": [`+
+			c.indicators+`]}`), ii)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, p := range ii.Validate() {
+			got = append(got, p.String())
+		}
+		if strings.Join(got, "\n") != strings.Join(c.expect, "\n") {
+			t.Errorf("%s: expected %q, got %q", c.name, c.expect,
+				got)
+		}
+	}
+
+}
+
+func TestMaxTermDepth(t *testing.T) {
+
+	deep := func(depth int) *Indicator {
+		term := &Term{Type: "t", Value: "a"}
+		for i := 0; i < depth; i++ {
+			term = &Term{Not: term}
+		}
+		return &Indicator{Id: "deep", Term: *term}
+	}
+
+	if err := deep(MaxTermDepth - 1).Check(); err != nil {
+		t.Errorf("depth %d rejected: %v", MaxTermDepth-1, err)
+	}
+
+	ii := &Indicators{Indicators: []*Indicator{deep(MaxTermDepth)}}
+	problems := ii.Validate()
+	path := "indicators[0]" + strings.Repeat(".not", MaxTermDepth)
+	if len(problems) != 1 || problems[0].Path != path {
+		t.Errorf("expected a problem at %s, got %v", path, problems)
+	}
+
+}
+
+// Lenient loading keeps the good indicators, and returns the problems with
+// the others.
+func TestLoadIndicatorsLenient(t *testing.T) {
+
+	ii, problems, err := LoadIndicatorsLenient([]byte(`{"indicators": [
+		{"id": "a", "type": "t", "value": "a"},
+		{"id": "b", "and": [{"type": "t"}]},
+		{"id": "c", "or": [{"type": "t", "value": "c"}]},
+		{"id": "d", "match": "regex", "type": "t", "value": "("}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{}
+	for _, ind := range ii.Indicators {
+		ids = append(ids, ind.Id)
+	}
+	if strings.Join(ids, ",") != "a,c" {
+		t.Errorf("expected indicators a,c, got %v", ids)
+	}
+
+	if len(problems) != 2 || problems[0].Path != "indicators[1].and[0]" ||
+		problems[0].Id != "b" || problems[1].Path != "indicators[3]" ||
+		problems[1].Id != "d" {
+		t.Errorf("wrong problems %v", problems)
+	}
+
+	if _, _, err := LoadIndicatorsLenient([]byte(`{`)); err == nil {
+		t.Error("invalid JSON accepted")
+	}
+
+}
@@ -0,0 +1,168 @@
+package indicators
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Returns the time window of an indicator, or zero if it has none.  A
+// window can be set on a top-level AND or sequence term, and limits the
+// time from the first token which moves the indicator's FSM out of 'init'
+// to the token which makes it hit.  Windows on nested terms are not
+// supported: the FSM has one clock, and a window on part of the tree
+// would need a clock for every subtree with one, which FSM states can't
+// represent without enumerating the times.
+func (i *Indicator) Window() (time.Duration, error) {
+
+	if i.Within == "" {
+		return 0, nil
+	}
+
+	if !i.IsAnd() && !i.IsSequence() {
+		return 0, errors.New("within is only supported on and and " +
+			"sequence terms")
+	}
+
+	window, err := time.ParseDuration(i.Within)
+	if err != nil {
+		return 0, fmt.Errorf("invalid within %q: %v", i.Within, err)
+	}
+	if window <= 0 {
+		return 0, fmt.Errorf("invalid within %q: must be positive",
+			i.Within)
+	}
+
+	return window, nil
+
+}
+
+// Builds the Windows index from the indicators.
+func (r *Ruleset) IndexWindows() error {
+	r.Windows = make([]time.Duration, len(r.Indicators))
+	r.windowed = false
+	for fsm, ind := range r.Indicators {
+		window, err := ind.Window()
+		if err != nil {
+			return fmt.Errorf("indicator %s: %v", ind.Id, err)
+		}
+		r.Windows[fsm] = window
+		if window > 0 {
+			r.windowed = true
+		}
+	}
+	return nil
+}
+
+// A symbol applied to an FSM with a time window.
+type windowEvent struct {
+	at       time.Time
+	sym      int32
+	token    Token
+	sequence uint64
+}
+
+// Remembers a symbol applied to an active FSM with a time window, until
+// the FSM hits or fails.  Symbols which are not in the FSM's table can
+// never move it, so are not kept.
+func (s *Scanner) remember(fsm, sym int32, at time.Time) {
+	if _, ok := s.Started[fsm]; !ok {
+		return
+	}
+	if s.Ruleset.Fsms[fsm].Column(sym) < 0 {
+		return
+	}
+	s.events[fsm] = append(s.events[fsm], windowEvent{
+		at:       at,
+		sym:      sym,
+		token:    s.token,
+		sequence: s.Sequence,
+	})
+}
+
+// Expires evidence of FSMs whose time window has passed.  FSMs which have
+// reached 'hit' or 'fail' are left alone.  Otherwise, symbols which are
+// older than the window are forgotten, and the FSM's progress is rebuilt
+// from those which are left, so that recent evidence is kept.  The cost
+// is proportional to the number of symbols in the window.
+func (s *Scanner) expire(at time.Time) {
+	for fsm, started := range s.Started {
+		state := s.State[fsm]
+		if state == StateHit || state == StateFail {
+			delete(s.Started, fsm)
+			delete(s.events, fsm)
+			continue
+		}
+		if at.Sub(started) > s.Ruleset.Windows[fsm] {
+			s.rewind(fsm, at)
+		}
+	}
+}
+
+// Rebuilds the state of an FSM from the symbols applied to it within its
+// window of time at.  If none of them move it out of 'init', the FSM
+// becomes inactive.
+func (s *Scanner) rewind(fsm int32, at time.Time) {
+
+	window := s.Ruleset.Windows[fsm]
+	table := s.Ruleset.Fsms[fsm]
+
+	events := s.events[fsm]
+	for len(events) > 0 && at.Sub(events[0].at) > window {
+		events = events[1:]
+	}
+
+	delete(s.paths, fsm)
+	state := StateInit
+	kept := []windowEvent{}
+	var hitBy windowEvent
+
+	for _, e := range events {
+		next, ok := table.Step(state, e.sym)
+		if state == StateInit {
+			// Symbols which don't move the FSM out of 'init'
+			// can't affect it.
+			if !ok {
+				continue
+			}
+			s.Started[fsm] = e.at
+		}
+		kept = append(kept, e)
+		if !ok {
+			continue
+		}
+		if s.Explain {
+			s.paths[fsm] = append(s.paths[fsm], pathStep{
+				state:    state,
+				sym:      e.sym,
+				next:     next,
+				token:    e.token,
+				sequence: e.sequence,
+			})
+		}
+		if next == StateHit && state != StateHit {
+			hitBy = e
+		}
+		state = next
+	}
+
+	if len(kept) == 0 {
+		delete(s.State, fsm)
+		delete(s.Started, fsm)
+		delete(s.events, fsm)
+		return
+	}
+
+	s.State[fsm] = state
+	s.events[fsm] = kept
+
+	// Replaying can complete an FSM, e.g. once the token a NOT
+	// negates has expired.  The hit is reported at the evidence which
+	// made it, not at the token being scanned.
+	if state == StateHit {
+		s.hits = append(s.hits, fsm)
+		s.replayed[fsm] = hitBy
+	}
+	s.drop(fsm, state)
+
+}
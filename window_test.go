@@ -0,0 +1,156 @@
+package indicators
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// A clock which a test moves by hand.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+// Scans tokens written type:value, each at the time in seconds given by
+// times, and returns the IDs of the indicators which hit.
+func windowHits(s *Scanner, tokens []string, times []int) []string {
+	clock := &fakeClock{}
+	s.Clock = clock.Now
+	for i, token := range tokens {
+		clock.now = time.Unix(int64(times[i]), 0)
+		s.Update(parseToken(token))
+	}
+	hits := []string{}
+	for _, ind := range s.GetHits() {
+		hits = append(hits, ind.Id)
+	}
+	return hits
+}
+
+func TestWindow(t *testing.T) {
+
+	ii, err := LoadIndicators([]byte(`{
+  "indicators": [
+    {
+      "id": "and",
+      "within": "30s",
+      "and": [
+        { "type": "t", "value": "a" },
+        { "type": "t", "value": "b" }
+      ]
+    },
+    {
+      "id": "sequence",
+      "within": "30s",
+      "sequence": [
+        { "type": "s", "value": "a" },
+        { "type": "s", "value": "b" },
+        { "type": "s", "value": "c" }
+      ]
+    }
+  ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := CreateRuleset(ii, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		tokens []string
+		times  []int
+		hits   []string
+	}{
+		{"within window", []string{"t:a", "t:b"}, []int{0, 30},
+			[]string{"and"}},
+		{"outside window", []string{"t:a", "t:b"}, []int{0, 31},
+			[]string{}},
+		{"newest evidence kept", []string{"t:a", "t:a", "t:b"},
+			[]int{0, 25, 40}, []string{"and"}},
+		{"newest evidence expires too", []string{"t:a", "t:a", "t:b"},
+			[]int{0, 5, 40}, []string{}},
+		{"sequence restarts from kept steps",
+			[]string{"s:a", "s:b", "s:a", "s:b", "s:c"},
+			[]int{0, 10, 20, 25, 45}, []string{"sequence"}},
+		{"sequence steps out of window",
+			[]string{"s:a", "s:b", "s:c"},
+			[]int{0, 20, 31}, []string{}},
+		{"sequence order kept after expiry",
+			[]string{"s:a", "s:b", "s:b", "s:c"},
+			[]int{0, 20, 25, 40}, []string{}},
+	} {
+		s := rs.NewScanner()
+		hits := windowHits(s, c.tokens, c.times)
+		if strings.Join(hits, ",") != strings.Join(c.hits, ",") {
+			t.Errorf("%s: got %v, expected %v", c.name, hits,
+				c.hits)
+		}
+	}
+
+}
+
+// Explanations only include evidence within the window.
+func TestWindowExplain(t *testing.T) {
+
+	ii, err := LoadIndicators([]byte(`{
+  "indicators": [
+    {
+      "id": "and",
+      "within": "30s",
+      "and": [
+        { "type": "t", "value": "a" },
+        { "type": "t", "value": "b" }
+      ]
+    }
+  ]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := CreateRuleset(ii, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := rs.NewScanner()
+	s.Explain = true
+	windowHits(s, []string{"t:a", "t:a", "t:b"}, []int{0, 25, 40})
+
+	explanations := s.ExplainHits()
+	if len(explanations) != 1 {
+		t.Fatalf("expected 1 explanation, got %d", len(explanations))
+	}
+	steps := explanations[0].Steps
+	if len(steps) != 2 || steps[0].Sequence != 2 ||
+		steps[1].Sequence != 3 {
+		t.Errorf("unexpected path:\n%s", explanations[0].Format())
+	}
+
+}
+
+func TestNestedWindowRejected(t *testing.T) {
+	_, err := LoadIndicators([]byte(`{
+  "indicators": [
+    {
+      "id": "nested",
+      "and": [
+        { "type": "t", "value": "a" },
+        { "within": "30s", "and": [
+          { "type": "t", "value": "b" },
+          { "type": "t", "value": "c" }
+        ] }
+      ]
+    }
+  ]
+}`))
+	if err == nil || !strings.Contains(err.Error(), "within") {
+		t.Errorf("expected nested within to be rejected, got %v", err)
+	}
+}